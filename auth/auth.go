@@ -0,0 +1,114 @@
+// Package auth authenticates tunnel sessions.
+//
+// On the server, wrap the server's SessionHooks with a Provider to require
+// clients to present valid credentials and to attach the identity they
+// authenticated as to their server.Session:
+//
+//	provider, err := auth.NewStaticTokens("/etc/tunnel/tokens")
+//	srv.SessionHooks = auth.Hooks(provider, srv.SessionHooks)
+//
+// On the client, pass the credentials as the auth extra:
+//
+//	sess.Auth("", auth.Token(token))
+//	tunnel.DialReconnecting("tcp", addr, auth.Token(token))
+package auth
+
+import (
+	"errors"
+	"time"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	server "github.com/inconshreveable/go-tunnel/server"
+)
+
+// ErrNoCredentials is returned by providers when the client did not send any credentials
+var ErrNoCredentials = errors.New("No credentials")
+
+// ErrInvalidCredentials is returned by providers when the client's credentials are not valid
+var ErrInvalidCredentials = errors.New("Invalid credentials")
+
+// Credentials is the Auth.Extra payload understood by the providers in this package
+type Credentials struct {
+	Token string // a bearer token, HMAC-signed token or JWT depending on the provider
+}
+
+// Token returns the auth extra for a client which authenticates with token.
+// It may be passed to client.Session.Auth and the Dial*Reconnecting functions.
+func Token(token string) *Credentials {
+	return &Credentials{Token: token}
+}
+
+// TokenFrom returns the token a client sent in its Auth message
+func TokenFrom(auth *proto.Auth) (string, error) {
+	if auth.Extra == nil {
+		return "", ErrNoCredentials
+	}
+
+	var creds Credentials
+	if err := proto.UnpackInterfaceField(auth.Extra, &creds); err != nil {
+		return "", err
+	}
+
+	if creds.Token == "" {
+		return "", ErrNoCredentials
+	}
+	return creds.Token, nil
+}
+
+// A Provider decides whether a client's Auth message is acceptable
+// and who the client authenticated as
+type Provider interface {
+	Authenticate(*proto.Auth) (*server.Identity, error)
+}
+
+// Any returns a Provider which accepts an Auth message if any
+// of the given providers does, trying them in order.
+func Any(providers ...Provider) Provider {
+	return anyProvider(providers)
+}
+
+type anyProvider []Provider
+
+func (p anyProvider) Authenticate(auth *proto.Auth) (identity *server.Identity, err error) {
+	err = ErrInvalidCredentials
+	for _, provider := range p {
+		if identity, err = provider.Authenticate(auth); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Hooks returns SessionHooks which authenticate every new session with provider
+// and record the identity it authenticated as with Session.SetIdentity before
+// passing control to next. next may be nil.
+func Hooks(provider Provider, next server.SessionHooks) server.SessionHooks {
+	if next == nil {
+		next = new(server.NoopSessionHooks)
+	}
+	return &hooks{SessionHooks: next, provider: provider}
+}
+
+type hooks struct {
+	server.SessionHooks
+	provider Provider
+}
+
+func (h *hooks) OnHeartbeat(sess *server.Session, rtt time.Duration) error {
+	if next, ok := h.SessionHooks.(server.HeartbeatHooks); ok {
+		return next.OnHeartbeat(sess, rtt)
+	}
+	return nil
+}
+
+func (h *hooks) OnAuth(sess *server.Session, auth *proto.Auth) error {
+	identity, err := h.provider.Authenticate(auth)
+	if err != nil {
+		sess.Warn("Authentication failed: %v", err)
+		return err
+	}
+
+	sess.SetIdentity(identity)
+	sess.Info("Authenticated as %s", identity.Name)
+	return h.SessionHooks.OnAuth(sess, auth)
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+)
+
+func TestHMAC(t *testing.T) {
+	p := NewHMAC([]byte("secret"))
+	other := NewHMAC([]byte("other secret"))
+	valid := p.Sign("alice", time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name string
+		auth *proto.Auth
+		err  string
+	}{
+		{"valid", authWithToken(valid), ""},
+		{"raw extra", &proto.Auth{Extra: proto.RawValue(`{"Token":"` + valid + `"}`)}, ""},
+		{"no extra", &proto.Auth{}, ErrNoCredentials.Error()},
+		{"empty token", authWithToken(""), ErrNoCredentials.Error()},
+		{"expired", authWithToken(p.Sign("alice", time.Now().Add(-time.Second))), "expired"},
+		{"other key", authWithToken(other.Sign("alice", time.Now().Add(time.Minute))), ErrInvalidCredentials.Error()},
+		{"changed identity", authWithToken("Ym9i" + valid[strings.Index(valid, "."):]), ErrInvalidCredentials.Error()},
+		{"changed expiry", authWithToken(strings.Replace(valid, ".", ".9", 1)), ErrInvalidCredentials.Error()},
+		{"missing signature", authWithToken(valid[:strings.LastIndex(valid, ".")]), ErrInvalidCredentials.Error()},
+		{"malformed signature", authWithToken(valid + "!"), ErrInvalidCredentials.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := p.Authenticate(tt.auth)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("rejected valid token: %v", err)
+				}
+				if identity.Name != "alice" {
+					t.Fatalf("authenticated as %q, want alice", identity.Name)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAny(t *testing.T) {
+	alice, bob := NewHMAC([]byte("alice's key")), NewHMAC([]byte("bob's key"))
+	p := Any(alice, bob)
+
+	identity, err := p.Authenticate(authWithToken(bob.Sign("bob", time.Now().Add(time.Minute))))
+	if err != nil || identity.Name != "bob" {
+		t.Errorf("got %v, %v, want bob's identity", identity, err)
+	}
+
+	if _, err = p.Authenticate(authWithToken(NewHMAC([]byte("x")).Sign("eve", time.Now().Add(time.Minute)))); err == nil {
+		t.Error("accepted a token no provider signed")
+	}
+	if _, err = Any().Authenticate(authWithToken("token")); err != ErrInvalidCredentials {
+		t.Errorf("got error %v from no providers, want ErrInvalidCredentials", err)
+	}
+}
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	server "github.com/inconshreveable/go-tunnel/server"
+)
+
+// JWT authenticates clients with JSON Web Tokens signed by one of the keys
+// in a local JWKS file. RS256, RS384, RS512, PS256, PS384, PS512, ES256,
+// ES384 and ES512 signatures are supported.
+//
+// The identity a token authenticates as is taken from its IdentityClaim
+// and all of the token's claims are attached to the identity.
+type JWT struct {
+	// Issuer, if set, must match the token's iss claim
+	Issuer string
+
+	// Audience, if set, must be one of the token's aud claims
+	Audience string
+
+	// IdentityClaim names the claim holding the identity's name. Defaults to "sub".
+	IdentityClaim string
+
+	// Leeway is the clock skew tolerated when checking the exp and nbf claims
+	Leeway time.Duration
+
+	keys map[string]crypto.PublicKey // key id -> key
+}
+
+// NewJWT creates a JWT provider which verifies tokens with the keys in the JWKS file at path
+func NewJWT(path string) (*JWT, error) {
+	keys, err := loadJWKS(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWT{
+		IdentityClaim: "sub",
+		Leeway:        time.Minute,
+		keys:          keys,
+	}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (p *JWT) Authenticate(auth *proto.Auth) (*server.Identity, error) {
+	token, err := TokenFrom(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed JWT")
+	}
+
+	var header jwtHeader
+	if err = decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Malformed JWT header: %v", err)
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed JWT signature: %v", err)
+	}
+
+	if err = verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	// the signature is valid, so the claims are trustworthy from here on
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Malformed JWT claims: %v", err)
+	}
+
+	if err = p.validate(claims); err != nil {
+		return nil, err
+	}
+
+	claim := p.IdentityClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	name, ok := claims[claim].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("JWT has no %s claim", claim)
+	}
+
+	return &server.Identity{Name: name, Claims: claims}, nil
+}
+
+func (p *JWT) key(kid string) (crypto.PublicKey, error) {
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	// tokens may omit the key id if there is only one key to choose from
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("JWT signed with unknown key %q", kid)
+}
+
+func (p *JWT) validate(claims map[string]interface{}) error {
+	now := time.Now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(p.Leeway)) {
+			return errors.New("JWT has expired")
+		}
+	} else {
+		return errors.New("JWT has no exp claim")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Before(time.Unix(int64(nbf), 0).Add(-p.Leeway)) {
+			return errors.New("JWT is not valid yet")
+		}
+	}
+
+	if p.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != p.Issuer {
+			return fmt.Errorf("JWT issued by %q, not %q", iss, p.Issuer)
+		}
+	}
+
+	if p.Audience != "" && !hasAudience(claims["aud"], p.Audience) {
+		return fmt.Errorf("JWT is not intended for %q", p.Audience)
+	}
+
+	return nil
+}
+
+// the aud claim may either be a single string or a list of them
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// esCurves maps each ECDSA JWT algorithm to the name of the curve it must be used with
+var esCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+func verifyJWT(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported JWT algorithm %q", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported JWT algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	// the key type must match the algorithm family so that a token
+	// can't choose how its signature is checked
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			// each ES algorithm is defined for a single curve, RFC 7518 section 3.4
+			if esCurves[alg] != k.Curve.Params().Name {
+				return fmt.Errorf("JWT algorithm %q requires a %s key, got %s", alg, esCurves[alg], k.Curve.Params().Name)
+			}
+
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(sig) != 2*size {
+				return errors.New("Malformed ECDSA signature")
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("ECDSA verification failure")
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("JWT algorithm %q does not match the signing key", alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(bytes, &jwks); err != nil {
+		return nil, fmt.Errorf("Failed to parse JWKS %s: %v", path, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load key %q from JWKS %s: %v", k.Kid, path, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no signing keys", path)
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+)
+
+var (
+	testRSAKey  = mustRSAKey()
+	testP256Key = mustECKey(elliptic.P256())
+	testP384Key = mustECKey(elliptic.P384())
+)
+
+func mustRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func mustECKey(curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// signJWT issues a token signed by key with alg, whatever the key type
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	signed := encodeSegment(t, jwtHeader{Alg: alg, Kid: kid}) + "." + encodeSegment(t, claims)
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, k, hash, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, signErr := ecdsa.Sign(rand.Reader, k, digest)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		err = signErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func authWithToken(token string) *proto.Auth {
+	return &proto.Auth{Extra: Token(token)}
+}
+
+func TestJWT(t *testing.T) {
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "exp": now + 60, "iss": "issuer", "aud": []string{"other", "tunnels"}}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	p := &JWT{
+		Issuer:        "issuer",
+		Audience:      "tunnels",
+		IdentityClaim: "sub",
+		Leeway:        time.Minute,
+		keys: map[string]crypto.PublicKey{
+			"rsa":  &testRSAKey.PublicKey,
+			"p256": &testP256Key.PublicKey,
+			"p384": &testP384Key.PublicKey,
+		},
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"RS256", signJWT(t, "RS256", "rsa", testRSAKey, valid()), ""},
+		{"RS512", signJWT(t, "RS512", "rsa", testRSAKey, valid()), ""},
+		{"PS256", signJWT(t, "PS256", "rsa", testRSAKey, valid()), ""},
+		{"ES256", signJWT(t, "ES256", "p256", testP256Key, valid()), ""},
+		{"ES384", signJWT(t, "ES384", "p384", testP384Key, valid()), ""},
+
+		// the algorithm must match the key it is verified with
+		{"RS256 with EC key", swapKid(t, signJWT(t, "RS256", "rsa", testRSAKey, valid()), "p256"), "does not match the signing key"},
+		{"ES256 with RSA key", signJWT(t, "ES256", "rsa", testP256Key, valid()), "does not match the signing key"},
+		{"HS256 with RSA key", signJWT(t, "HS256", "rsa", testRSAKey, valid()), "does not match the signing key"},
+		{"none", encodeSegment(t, jwtHeader{Alg: "none", Kid: "rsa"}) + "." + encodeSegment(t, valid()) + ".", "Unsupported JWT algorithm"},
+		{"ES384 with P-256 key", signJWT(t, "ES384", "p256", testP256Key, valid()), "requires a P-384 key"},
+		{"ES256 with P-384 key", signJWT(t, "ES256", "p384", testP384Key, valid()), "requires a P-256 key"},
+		{"ES256 signed by another key", signJWT(t, "ES256", "p256", mustECKey(elliptic.P256()), valid()), "ECDSA verification failure"},
+		{"RS256 signed by another key", signJWT(t, "RS256", "rsa", mustRSAKey(), valid()), "verification error"},
+		{"unknown key", signJWT(t, "RS256", "nope", testRSAKey, valid()), "unknown key"},
+		{"tampered claims", tamper(t, signJWT(t, "RS256", "rsa", testRSAKey, valid())), "verification error"},
+		{"malformed", "a.b", "Malformed JWT"},
+
+		// claims
+		{"expired within leeway", signJWT(t, "RS256", "rsa", testRSAKey, with("exp", now-30)), ""},
+		{"expired", signJWT(t, "RS256", "rsa", testRSAKey, with("exp", now-120)), "JWT has expired"},
+		{"no exp", signJWT(t, "RS256", "rsa", testRSAKey, with("exp", nil)), "no exp claim"},
+		{"not yet valid within leeway", signJWT(t, "RS256", "rsa", testRSAKey, with("nbf", now+30)), ""},
+		{"not yet valid", signJWT(t, "RS256", "rsa", testRSAKey, with("nbf", now+120)), "not valid yet"},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", testRSAKey, with("iss", "other")), "JWT issued by"},
+		{"single audience", signJWT(t, "RS256", "rsa", testRSAKey, with("aud", "tunnels")), ""},
+		{"wrong audience", signJWT(t, "RS256", "rsa", testRSAKey, with("aud", "other")), "not intended for"},
+		{"no identity", signJWT(t, "RS256", "rsa", testRSAKey, with("sub", nil)), "no sub claim"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := p.Authenticate(authWithToken(tt.token))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("rejected valid token: %v", err)
+			case tt.err == "" && identity.Name != "alice":
+				t.Fatalf("authenticated as %q, want alice", identity.Name)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// swapKid replaces the key id in the header of token without signing it again
+func swapKid(t *testing.T, token, kid string) string {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		t.Fatal(err)
+	}
+	header.Kid = kid
+	parts[0] = encodeSegment(t, header)
+	return strings.Join(parts, ".")
+}
+
+// tamper replaces the claims of token without signing it again
+func tamper(t *testing.T, token string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = encodeSegment(t, map[string]interface{}{"sub": "mallory", "exp": time.Now().Unix() + 60})
+	return strings.Join(parts, ".")
+}
+
+func TestJWTWithoutKid(t *testing.T) {
+	claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Unix() + 60}
+	single := &JWT{keys: map[string]crypto.PublicKey{"rsa": &testRSAKey.PublicKey}}
+	if _, err := single.Authenticate(authWithToken(signJWT(t, "RS256", "", testRSAKey, claims))); err != nil {
+		t.Errorf("rejected a token without kid for the only key: %v", err)
+	}
+
+	several := &JWT{keys: map[string]crypto.PublicKey{"rsa": &testRSAKey.PublicKey, "p256": &testP256Key.PublicKey}}
+	if _, err := several.Authenticate(authWithToken(signJWT(t, "RS256", "", testRSAKey, claims))); err == nil {
+		t.Error("accepted a token without kid among several keys")
+	}
+}
+
+func TestNewJWT(t *testing.T) {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	rsaKey := map[string]string{
+		"kty": "RSA", "kid": "rsa", "use": "sig",
+		"n": b64(testRSAKey.N.Bytes()), "e": b64([]byte{1, 0, 1}),
+	}
+	ecKey := map[string]string{
+		"kty": "EC", "kid": "p256", "crv": "P-256",
+		"x": b64(testP256Key.X.Bytes()), "y": b64(testP256Key.Y.Bytes()),
+	}
+	encKey := map[string]string{"kty": "RSA", "kid": "enc", "use": "enc"}
+	offCurve := map[string]string{"kty": "EC", "kid": "bad", "crv": "P-256", "x": b64([]byte{1}), "y": b64([]byte{2})}
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		keys []map[string]string
+		err  string
+	}{
+		{"valid", []map[string]string{rsaKey, ecKey, encKey}, ""},
+		{"no signing keys", []map[string]string{encKey}, "no signing keys"},
+		{"point off the curve", []map[string]string{rsaKey, offCurve}, "not on the curve"},
+		{"unknown curve", []map[string]string{{"kty": "EC", "crv": "P-224"}}, "Unsupported curve"},
+		{"unknown key type", []map[string]string{{"kty": "oct"}}, "Unsupported key type"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bytes, err := json.Marshal(map[string]interface{}{"keys": tt.keys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, string(rune('a'+i))+".json")
+			if err = ioutil.WriteFile(path, bytes, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := NewJWT(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(p.keys) != 2 {
+				t.Fatalf("loaded %d keys, want the 2 signing keys", len(p.keys))
+			}
+
+			claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Unix() + 60}
+			if _, err = p.Authenticate(authWithToken(signJWT(t, "ES256", "p256", testP256Key, claims))); err != nil {
+				t.Errorf("rejected token signed with a loaded key: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	server "github.com/inconshreveable/go-tunnel/server"
+)
+
+// StaticTokens authenticates clients with bearer tokens listed in a file.
+//
+// Each line of the file holds a token and the name of the identity it
+// authenticates as, separated by whitespace. Blank lines and lines starting
+// with # are ignored:
+//
+//	# token                           identity
+//	5f1c0b7e9a2d4c3e8b6a1f0d2c4e6a8b  alice
+//	9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b  bob
+type StaticTokens struct {
+	path string
+
+	sync.RWMutex
+	identities map[[sha256.Size]byte]string // hash of token -> identity name
+}
+
+// NewStaticTokens loads the tokens in the file at path
+func NewStaticTokens(path string) (*StaticTokens, error) {
+	p := &StaticTokens{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the token file again, replacing all of the tokens previously loaded
+func (p *StaticTokens) Reload() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	identities := make(map[[sha256.Size]byte]string)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected a token and an identity", p.path, lineno)
+		}
+		identities[sha256.Sum256([]byte(fields[0]))] = fields[1]
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.identities = identities
+	return nil
+}
+
+func (p *StaticTokens) Authenticate(auth *proto.Auth) (*server.Identity, error) {
+	token, err := TokenFrom(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// look up the hash of the token so that the time taken doesn't depend on
+	// how much of the token matches a valid one
+	p.RLock()
+	name, ok := p.identities[sha256.Sum256([]byte(token))]
+	p.RUnlock()
+
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return &server.Identity{Name: name}, nil
+}
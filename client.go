@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 
@@ -15,16 +16,64 @@ func Client(conn net.Conn) *client.Session {
 
 // Dial starts a go-tunnel session on a new connection to addr
 func Dial(network, addr string) (*client.Session, error) {
-	mux, err := muxado.Dial(network, addr)
+	return DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial, but gives up connecting once ctx is done.
+// ctx only applies to establishing the connection, not to the returned session.
+func DialContext(ctx context.Context, network, addr string) (*client.Session, error) {
+	mux, err := dialContext(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 	return client.NewSession(mux), nil
 }
 
+func dialContext(ctx context.Context, network, addr string) (muxado.Session, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return muxado.Client(conn), nil
+}
+
 // DialExtra starts a go-tunnel session on a new tls connection to addr
 func DialTLS(network, addr string, tlsConfig *tls.Config) (*client.Session, error) {
-	mux, err := muxado.DialTLS(network, addr, tlsConfig)
+	return DialTLSContext(context.Background(), network, addr, tlsConfig)
+}
+
+// DialTLSContext is like DialTLS, but gives up connecting once ctx is done.
+// ctx only applies to establishing the connection, not to the returned session.
+func DialTLSContext(ctx context.Context, network, addr string, tlsConfig *tls.Config) (*client.Session, error) {
+	mux, err := dialTLSContext(ctx, network, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewSession(mux), nil
+}
+
+func dialTLSContext(ctx context.Context, network, addr string, tlsConfig *tls.Config) (muxado.Session, error) {
+	dialer := &tls.Dialer{Config: tlsConfig}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return muxado.Client(conn), nil
+}
+
+// DialEnvironmentProxy starts a go-tunnel session on a new connection to addr made through
+// the proxy configured by the HTTPS_PROXY, HTTP_PROXY, ALL_PROXY and NO_PROXY environment
+// variables, see client.ProxyFromEnvironment. The connection to addr is made over TLS
+// unless tlsConfig is nil.
+func DialEnvironmentProxy(network, addr string, tlsConfig *tls.Config) (*client.Session, error) {
+	return DialEnvironmentProxyContext(context.Background(), network, addr, tlsConfig)
+}
+
+// DialEnvironmentProxyContext is like DialEnvironmentProxy, but gives up connecting once ctx is done.
+// ctx only applies to establishing the connection, not to the returned session.
+func DialEnvironmentProxyContext(ctx context.Context, network, addr string, tlsConfig *tls.Config) (*client.Session, error) {
+	mux, err := client.DialEnvironmentContext(ctx, network, addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -35,20 +84,50 @@ func DialTLS(network, addr string, tlsConfig *tls.Config) (*client.Session, erro
 // over a new connection to addr. The ReconnectingSessions will initially Auth to the server with authExtra
 // as well as whenever it reconnects.
 func DialReconnecting(network, addr string, authExtra interface{}) (*client.ReconnectingSession, error) {
-	dialer := func() (muxado.Session, error) {
-		return muxado.Dial(network, addr)
-	}
-
-	return client.NewReconnectingSession(dialer, authExtra)
+	return DialReconnectingContext(context.Background(), network, addr, authExtra, nil)
 }
 
 // DialTLSReconnecting starts a go-tunnel session managed by a ReconnectingSession object
 // over a new TLS connection to addr. The ReconnectingSessions will initially Auth to the server with authExtra
 // as well as whenever it reconnects.
 func DialTLSReconnecting(network, addr string, tlsConfig *tls.Config, authExtra interface{}) (*client.ReconnectingSession, error) {
+	return DialTLSReconnectingContext(context.Background(), network, addr, tlsConfig, authExtra, nil)
+}
+
+// DialReconnectingContext is like DialReconnecting, but reconnects according to policy,
+// which may be nil for the client.DefaultReconnectPolicy. ctx bounds every attempt to
+// connect and the lifetime of the session: once it is done, the session is closed.
+func DialReconnectingContext(ctx context.Context, network, addr string, authExtra interface{}, policy *client.ReconnectPolicy) (*client.ReconnectingSession, error) {
 	dialer := func() (muxado.Session, error) {
-		return muxado.DialTLS(network, addr, tlsConfig)
+		return dialContext(ctx, network, addr)
 	}
 
-	return client.NewReconnectingSession(dialer, authExtra)
+	return client.NewReconnectingSessionContext(ctx, dialer, authExtra, policy)
+}
+
+// DialTLSReconnectingContext is like DialTLSReconnecting, but reconnects according to policy,
+// which may be nil for the client.DefaultReconnectPolicy. ctx bounds every attempt to
+// connect and the lifetime of the session: once it is done, the session is closed.
+func DialTLSReconnectingContext(ctx context.Context, network, addr string, tlsConfig *tls.Config, authExtra interface{}, policy *client.ReconnectPolicy) (*client.ReconnectingSession, error) {
+	dialer := func() (muxado.Session, error) {
+		return dialTLSContext(ctx, network, addr, tlsConfig)
+	}
+
+	return client.NewReconnectingSessionContext(ctx, dialer, authExtra, policy)
+}
+
+// DialEnvironmentProxyReconnecting starts a go-tunnel session managed by a ReconnectingSession object
+// over a new connection to addr made through the proxy configured in the environment, like
+// DialEnvironmentProxy. The connection is made over TLS unless tlsConfig is nil. The environment
+// is read again whenever the session reconnects.
+func DialEnvironmentProxyReconnecting(network, addr string, tlsConfig *tls.Config, authExtra interface{}) (*client.ReconnectingSession, error) {
+	return DialEnvironmentProxyReconnectingContext(context.Background(), network, addr, tlsConfig, authExtra, nil)
+}
+
+// DialEnvironmentProxyReconnectingContext is like DialEnvironmentProxyReconnecting, but reconnects according
+// to policy, which may be nil for the client.DefaultReconnectPolicy. ctx bounds every attempt to connect
+// and the lifetime of the session: once it is done, the session is closed.
+func DialEnvironmentProxyReconnectingContext(ctx context.Context, network, addr string, tlsConfig *tls.Config, authExtra interface{}, policy *client.ReconnectPolicy) (*client.ReconnectingSession, error) {
+	dialer := client.EnvironmentDialerContext(ctx, network, addr, tlsConfig)
+	return client.NewReconnectingSessionContext(ctx, dialer, authExtra, policy)
 }
@@ -0,0 +1,151 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Jitter selects how a ReconnectPolicy randomizes the delays between attempts
+type Jitter int
+
+const (
+	// NoJitter waits exactly the exponentially increasing delay
+	NoJitter Jitter = iota
+
+	// FullJitter waits a random time between zero and the exponentially increasing delay
+	FullJitter
+
+	// DecorrelatedJitter waits a random time between InitialDelay and Multiplier
+	// times the previous delay
+	DecorrelatedJitter
+)
+
+// A ReconnectPolicy decides how long a ReconnectingSession waits between attempts to
+// reconnect to the server and when it gives up. Zero fields take their defaults.
+type ReconnectPolicy struct {
+	// InitialDelay is the delay after the first failed attempt. Defaults to 1 second.
+	InitialDelay time.Duration
+
+	// MaxDelay caps the delay between attempts. Defaults to 30 seconds.
+	MaxDelay time.Duration
+
+	// Multiplier is the factor by which the delay grows after each failed attempt. Defaults to 2.
+	Multiplier float64
+
+	// Jitter randomizes the delays so that many clients which lost their connection
+	// at the same time don't all reconnect at the same time
+	Jitter Jitter
+
+	// MaxAttempts is how many times to try to reconnect before giving up. Zero means no limit.
+	MaxAttempts int
+
+	// MaxElapsed is how long to keep trying to reconnect before giving up. Zero means no limit.
+	MaxElapsed time.Duration
+
+	// IsPermanent decides whether an error means the session can never be reconnected.
+	// It is called with errors from dialing the server, as well as with a *ServerError
+	// when the server rejects the session's credentials or one of its tunnels.
+	// Defaults to treating only the errors reported by the server as permanent.
+	IsPermanent func(error) bool
+}
+
+// DefaultReconnectPolicy is the policy used by NewReconnectingSession. It retries forever,
+// doubling the delay between attempts from 1 second up to 30 seconds, without jitter.
+var DefaultReconnectPolicy = &ReconnectPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+}
+
+// A ServerError is an error the server reported in reply to a request from the client
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return e.Msg
+}
+
+func isServerError(err error) bool {
+	_, ok := err.(*ServerError)
+	return ok
+}
+
+// backoff tracks the attempts to reconnect after the connection to the server was lost
+type backoff struct {
+	*ReconnectPolicy
+	rand     *rand.Rand
+	start    time.Time     // when the first attempt failed
+	attempts int           // failed attempts so far
+	delay    time.Duration // the previous delay
+}
+
+func newBackoff(p *ReconnectPolicy) *backoff {
+	if p == nil {
+		p = DefaultReconnectPolicy
+	}
+
+	// fill in defaults without modifying the caller's policy
+	policy := *p
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = DefaultReconnectPolicy.InitialDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultReconnectPolicy.MaxDelay
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = DefaultReconnectPolicy.Multiplier
+	}
+	if policy.IsPermanent == nil {
+		policy.IsPermanent = isServerError
+	}
+
+	return &backoff{
+		ReconnectPolicy: &policy,
+		rand:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// reset starts counting attempts from scratch after the session connected successfully
+func (b *backoff) reset() {
+	b.attempts, b.delay = 0, 0
+}
+
+// next records a failed attempt and returns how long to wait before the next one.
+// ok is false if the policy says to give up.
+func (b *backoff) next() (delay time.Duration, ok bool) {
+	if b.attempts == 0 {
+		b.start = time.Now()
+	}
+	b.attempts++
+
+	if b.MaxAttempts > 0 && b.attempts >= b.MaxAttempts {
+		return 0, false
+	}
+
+	switch b.Jitter {
+	case DecorrelatedJitter:
+		upper := float64(b.InitialDelay) * b.Multiplier
+		if b.delay > 0 {
+			upper = math.Max(upper, float64(b.delay)*b.Multiplier)
+		}
+		delay = b.InitialDelay + time.Duration(b.rand.Int63n(int64(upper)-int64(b.InitialDelay)+1))
+	default:
+		exp := float64(b.InitialDelay) * math.Pow(b.Multiplier, float64(b.attempts-1))
+		delay = time.Duration(math.Min(exp, float64(b.MaxDelay)))
+		if b.Jitter == FullJitter {
+			delay = time.Duration(b.rand.Int63n(int64(delay) + 1))
+		}
+	}
+
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+	b.delay = delay
+
+	if b.MaxElapsed > 0 && time.Since(b.start)+delay > b.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// digest is a Digest authentication challenge from a proxy's Proxy-Authenticate header (RFC 7616)
+type digest struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       []string
+}
+
+// proxyAuthorization returns the Proxy-Authorization header answering the challenge of a 407
+// response's Proxy-Authenticate headers. Digest authentication is preferred over Basic.
+func proxyAuthorization(h http.Header, user, password, method, uri string) (string, error) {
+	if d, ok := digestChallenge(h); ok {
+		return d.authorize(user, password, method, uri)
+	}
+
+	for _, v := range h[http.CanonicalHeaderKey("Proxy-Authenticate")] {
+		if strings.EqualFold(v, "Basic") || (len(v) >= 6 && strings.EqualFold(v[:6], "Basic ")) {
+			return basicAuth(user, password), nil
+		}
+	}
+	return "", fmt.Errorf("Proxy requires an unsupported authentication scheme: %s", strings.Join(h[http.CanonicalHeaderKey("Proxy-Authenticate")], "; "))
+}
+
+// digestChallenge finds the Digest challenge among a 407 response's Proxy-Authenticate headers
+func digestChallenge(h http.Header) (*digest, bool) {
+	for _, v := range h[http.CanonicalHeaderKey("Proxy-Authenticate")] {
+		if len(v) < 7 || !strings.EqualFold(v[:7], "Digest ") {
+			continue
+		}
+
+		params := parseAuthParams(v[7:])
+		d := &digest{
+			realm:     params["realm"],
+			nonce:     params["nonce"],
+			opaque:    params["opaque"],
+			algorithm: params["algorithm"],
+		}
+		for _, qop := range strings.Split(params["qop"], ",") {
+			if qop = strings.TrimSpace(qop); qop != "" {
+				d.qop = append(d.qop, qop)
+			}
+		}
+		return d, true
+	}
+	return nil, false
+}
+
+// authorize returns the Proxy-Authorization header answering the challenge
+func (d *digest) authorize(user, password, method, uri string) (string, error) {
+	algorithm := strings.ToUpper(d.algorithm)
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("Unsupported digest algorithm: %s", d.algorithm)
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	cnonce, err := newCnonce()
+	if err != nil {
+		return "", err
+	}
+	const nc = "00000001"
+
+	ha1 := h(user + ":" + d.realm + ":" + password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = h(ha1 + ":" + d.nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	var qop string
+	for _, q := range d.qop {
+		if q == "auth" {
+			qop = q
+		}
+	}
+	if len(d.qop) > 0 && qop == "" {
+		return "", fmt.Errorf("Unsupported digest qop: %s", strings.Join(d.qop, ", "))
+	}
+
+	var response string
+	if qop == "" {
+		response = h(ha1 + ":" + d.nonce + ":" + ha2)
+	} else {
+		response = h(strings.Join([]string{ha1, d.nonce, nc, cnonce, qop, ha2}, ":"))
+	}
+
+	fields := []string{
+		fmt.Sprintf("username=%q", user),
+		fmt.Sprintf("realm=%q", d.realm),
+		fmt.Sprintf("nonce=%q", d.nonce),
+		fmt.Sprintf("uri=%q", uri),
+		fmt.Sprintf("algorithm=%s", algorithm),
+		fmt.Sprintf("response=%q", response),
+	}
+	if d.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", d.opaque))
+	}
+	if qop != "" {
+		fields = append(fields, "qop="+qop, "nc="+nc, fmt.Sprintf("cnonce=%q", cnonce))
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
+
+func newCnonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseAuthParams parses the comma separated key=value and key="quoted value" parameters of a challenge
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // skip the closing quote
+			}
+			value, s = b.String(), s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[key] = value
+	}
+}
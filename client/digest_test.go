@@ -0,0 +1,333 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{``, map[string]string{}},
+		{`realm="proxy"`, map[string]string{"realm": "proxy"}},
+		{`Realm=proxy, NONCE="abc"`, map[string]string{"realm": "proxy", "nonce": "abc"}},
+		{`realm="a, b", qop="auth,auth-int"`, map[string]string{"realm": "a, b", "qop": "auth,auth-int"}},
+		{`realm="say \"hi\"", stale=false`, map[string]string{"realm": `say "hi"`, "stale": "false"}},
+		{` , realm = "x" ,, algorithm=MD5`, map[string]string{"realm": "x", "algorithm": "MD5"}},
+		{`realm="unterminated`, map[string]string{"realm": "unterminated"}},
+		{`token68`, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		got := parseAuthParams(tt.in)
+		if len(got) != len(tt.want) {
+			t.Errorf("parseAuthParams(%q) = %v, want %v", tt.in, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("parseAuthParams(%q) = %v, want %v", tt.in, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		ok      bool
+		want    digest
+	}{
+		{"none", nil, false, digest{}},
+		{"basic only", []string{`Basic realm="proxy"`}, false, digest{}},
+		{"digest", []string{`Basic realm="proxy"`, `Digest realm="proxy", nonce="n", opaque="o", algorithm=SHA-256, qop="auth, auth-int"`}, true,
+			digest{realm: "proxy", nonce: "n", opaque: "o", algorithm: "SHA-256", qop: []string{"auth", "auth-int"}}},
+		{"lowercase scheme", []string{`digest realm="proxy", nonce="n"`}, true, digest{realm: "proxy", nonce: "n"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{"Proxy-Authenticate": tt.headers}
+			d, ok := digestChallenge(h)
+			if ok != tt.ok {
+				t.Fatalf("found challenge %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if d.realm != tt.want.realm || d.nonce != tt.want.nonce || d.opaque != tt.want.opaque ||
+				d.algorithm != tt.want.algorithm || strings.Join(d.qop, ",") != strings.Join(tt.want.qop, ",") {
+				t.Errorf("parsed %+v, want %+v", *d, tt.want)
+			}
+		})
+	}
+}
+
+// checkDigest verifies a Digest Proxy-Authorization header like a proxy would
+func checkDigest(t *testing.T, header, password, method string) {
+	t.Helper()
+	if !strings.HasPrefix(header, "Digest ") {
+		t.Fatalf("authorization %q is not a Digest", header)
+	}
+	params := parseAuthParams(header[len("Digest "):])
+
+	var newHash func() hash.Hash
+	switch params["algorithm"] {
+	case "MD5", "MD5-SESS":
+		newHash = md5.New
+	case "SHA-256", "SHA-256-SESS":
+		newHash = sha256.New
+	default:
+		t.Fatalf("unexpected algorithm %q", params["algorithm"])
+	}
+	h := func(s string) string {
+		sum := newHash()
+		sum.Write([]byte(s))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := h(params["username"] + ":" + params["realm"] + ":" + password)
+	if strings.HasSuffix(params["algorithm"], "-SESS") {
+		ha1 = h(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := h(method + ":" + params["uri"])
+
+	want := h(ha1 + ":" + params["nonce"] + ":" + ha2)
+	if params["qop"] != "" {
+		want = h(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" + params["cnonce"] + ":" + params["qop"] + ":" + ha2)
+	}
+	if params["response"] != want {
+		t.Errorf("digest response %s, want %s", params["response"], want)
+	}
+}
+
+func TestDigestAuthorize(t *testing.T) {
+	tests := []struct {
+		name string
+		d    digest
+		err  string
+	}{
+		{"md5", digest{realm: "proxy", nonce: "n"}, ""},
+		{"md5 auth", digest{realm: "proxy", nonce: "n", opaque: "o", qop: []string{"auth-int", "auth"}}, ""},
+		{"sha-256", digest{realm: "proxy", nonce: "n", algorithm: "sha-256", qop: []string{"auth"}}, ""},
+		{"md5-sess", digest{realm: "proxy", nonce: "n", algorithm: "MD5-sess", qop: []string{"auth"}}, ""},
+		{"unsupported algorithm", digest{realm: "proxy", nonce: "n", algorithm: "SHA-512-256"}, "Unsupported digest algorithm"},
+		{"unsupported qop", digest{realm: "proxy", nonce: "n", qop: []string{"auth-int"}}, "Unsupported digest qop"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := tt.d.authorize("alice", "secret", "CONNECT", "tunnel.example.com:4443")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkDigest(t, header, "secret", "CONNECT")
+			params := parseAuthParams(header[len("Digest "):])
+			if params["username"] != "alice" || params["uri"] != "tunnel.example.com:4443" || params["opaque"] != tt.d.opaque {
+				t.Errorf("authorization %q doesn't echo the challenge", header)
+			}
+		})
+	}
+}
+
+func TestProxyAuthorization(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		scheme  string
+		err     string
+	}{
+		{"basic", []string{`Basic realm="proxy"`}, "Basic ", ""},
+		{"bare basic", []string{`basic`}, "Basic ", ""},
+		{"digest preferred", []string{`Basic realm="proxy"`, `Digest realm="proxy", nonce="n"`}, "Digest ", ""},
+		{"unsupported", []string{`Negotiate`, `NTLM`}, "", "unsupported authentication scheme: Negotiate; NTLM"},
+		{"no challenge", nil, "", "unsupported authentication scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := proxyAuthorization(http.Header{"Proxy-Authenticate": tt.headers}, "alice", "secret", "CONNECT", "tunnel.example.com:4443")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(header, tt.scheme) {
+				t.Errorf("authorization %q, want the %s scheme", header, tt.scheme)
+			}
+		})
+	}
+}
+
+// testProxy is an HTTP proxy which answers CONNECT requests without credentials with
+// a 407 carrying challenge and any other CONNECT request by greeting the client. It
+// passes every request on to the test.
+type testProxy struct {
+	challenge  string // Proxy-Authenticate header, empty if the proxy needs no credentials
+	closeOn407 bool   // close the connection after a 407
+	requests   chan *http.Request
+}
+
+func newTestProxy(t *testing.T, challenge string, closeOn407 bool) (*testProxy, *url.URL) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	p := &testProxy{challenge: challenge, closeOn407: closeOn407, requests: make(chan *http.Request, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p, &url.URL{Scheme: "http", Host: l.Addr().String(), User: url.UserPassword("alice", "secret")}
+}
+
+func (p *testProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		p.requests <- req
+
+		auth := req.Header.Get("Proxy-Authorization")
+		if p.challenge != "" && auth == "" {
+			body := "credentials required"
+			resp := "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: " + p.challenge + "\r\n"
+			if p.closeOn407 {
+				resp += "Connection: close\r\n"
+			}
+			conn.Write([]byte(resp + "Content-Length: 20\r\n\r\n" + body))
+			if p.closeOn407 {
+				return
+			}
+			continue
+		}
+
+		// the server speaks first, right after the proxy's response
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nhello"))
+		return
+	}
+}
+
+func TestHTTPProxyDialContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		challenge  string
+		closeOn407 bool
+		noUser     bool
+		scheme     string
+		err        string
+	}{
+		{"no auth", "", false, false, "", ""},
+		{"basic", `Basic realm="proxy"`, false, false, "Basic ", ""},
+		{"basic on new connection", `Basic realm="proxy"`, true, false, "Basic ", ""},
+		{"digest", `Digest realm="proxy", nonce="abc", qop="auth", algorithm=SHA-256`, false, false, "Digest ", ""},
+		{"no credentials", `Basic realm="proxy"`, false, true, "", "407"},
+		{"unsupported scheme", `Negotiate`, false, false, "", "unsupported authentication scheme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, proxyUrl := newTestProxy(t, tt.challenge, tt.closeOn407)
+			if tt.noUser {
+				proxyUrl.User = nil
+			}
+
+			p := &HTTPProxy{URL: proxyUrl, Header: http.Header{"User-Agent": {"test"}}}
+			conn, err := p.DialContext(context.Background(), "tcp", "tunnel.example.com:4443")
+
+			// credentials must never be sent before the proxy asks for them
+			first := <-proxy.requests
+			if auth := first.Header.Get("Proxy-Authorization"); auth != "" {
+				t.Errorf("first CONNECT carried credentials %q", auth)
+			}
+			if first.Host != "tunnel.example.com:4443" || first.Header.Get("User-Agent") != "test" {
+				t.Errorf("CONNECT for %s with User-Agent %q", first.Host, first.Header.Get("User-Agent"))
+			}
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if tt.scheme != "" {
+				retry := <-proxy.requests
+				auth := retry.Header.Get("Proxy-Authorization")
+				if !strings.HasPrefix(auth, tt.scheme) {
+					t.Fatalf("retried with authorization %q, want the %s scheme", auth, tt.scheme)
+				}
+				if tt.scheme == "Digest " {
+					checkDigest(t, auth, "secret", "CONNECT")
+				} else if auth != basicAuth("alice", "secret") {
+					t.Errorf("retried with authorization %q", auth)
+				}
+			}
+
+			greeting, err := ioutil.ReadAll(conn)
+			if err != nil || string(greeting) != "hello" {
+				t.Errorf("read %q, %v through the proxy, want the server's greeting", greeting, err)
+			}
+		})
+	}
+}
+
+func TestProxyDialersRequireTLS(t *testing.T) {
+	proxyUrl := &url.URL{Scheme: "http", Host: "127.0.0.1:1"}
+	dialers := map[string]func() (interface{}, error){
+		"HTTPDialer": func() (interface{}, error) {
+			return HTTPDialer("tcp", proxyUrl.String(), "tunnel.example.com:4443", nil)()
+		},
+		"HTTPProxy.Dialer": func() (interface{}, error) {
+			return (&HTTPProxy{URL: proxyUrl}).Dialer("tcp", "tunnel.example.com:4443", nil)()
+		},
+		"SOCKS5Dialer": func() (interface{}, error) {
+			return SOCKS5Dialer("tcp", "127.0.0.1:1", "", "", "tunnel.example.com:4443", nil)()
+		},
+	}
+
+	for name, dial := range dialers {
+		if _, err := dial(); err != errNoTLSConfig {
+			t.Errorf("%s without a TLS config got error %v, want errNoTLSConfig", name, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	muxado "github.com/inconshreveable/muxado"
+	"golang.org/x/net/proxy"
+)
+
+// EnvironmentDialer returns a dialer for NewReconnectingSession which connects to addr
+// through the proxy configured in the environment, see ProxyFromEnvironment. The connection
+// is upgraded to TLS if tlsConfig is not nil. The environment is read again on every dial.
+func EnvironmentDialer(network, addr string, tlsConfig *tls.Config) func() (muxado.Session, error) {
+	return EnvironmentDialerContext(context.Background(), network, addr, tlsConfig)
+}
+
+// EnvironmentDialerContext is like EnvironmentDialer, but every dial gives up once ctx is done
+func EnvironmentDialerContext(ctx context.Context, network, addr string, tlsConfig *tls.Config) func() (muxado.Session, error) {
+	return func() (muxado.Session, error) {
+		return DialEnvironmentContext(ctx, network, addr, tlsConfig)
+	}
+}
+
+// DialEnvironmentContext connects to addr through the proxy configured in the environment,
+// or directly if there is none, and upgrades the connection to TLS if tlsConfig is not nil.
+// It gives up connecting once ctx is done.
+func DialEnvironmentContext(ctx context.Context, network, addr string, tlsConfig *tls.Config) (muxado.Session, error) {
+	proxyUrl, err := ProxyFromEnvironment(addr, tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if proxyUrl == nil {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, addr)
+	} else {
+		conn, err = dialProxy(ctx, network, proxyUrl, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		if conn, err = clientTLS(ctx, conn, addr, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return muxado.Client(conn), nil
+}
+
+// ProxyFromEnvironment returns the URL of the proxy to use to connect to addr according to the
+// HTTPS_PROXY (if secure is true) or HTTP_PROXY (if it is false) environment variables, falling
+// back to ALL_PROXY, or their lowercase versions. It returns nil if no proxy is configured or
+// addr matches NO_PROXY. The proxy is an HTTP proxy if its scheme is http, https or missing,
+// and a SOCKS5 proxy if its scheme is socks5 or socks5h.
+//
+// NO_PROXY is a comma separated list of host names, which also match their subdomains, IP
+// addresses and CIDR ranges, each optionally followed by a port. "*" disables the proxy for
+// every address. Connections to localhost and loopback addresses never use a proxy.
+func ProxyFromEnvironment(addr string, secure bool) (*url.URL, error) {
+	var proxyEnv string
+	if secure {
+		proxyEnv = getenv("HTTPS_PROXY")
+	} else {
+		proxyEnv = getenv("HTTP_PROXY")
+	}
+	if proxyEnv == "" {
+		proxyEnv = getenv("ALL_PROXY")
+	}
+
+	if proxyEnv == "" || !useProxy(addr, getenv("NO_PROXY")) {
+		return nil, nil
+	}
+
+	proxyUrl, err := url.Parse(proxyEnv)
+	if err != nil || proxyUrl.Host == "" {
+		// proxies are often configured as host:port without a scheme
+		if proxyUrl, err = url.Parse("http://" + proxyEnv); err != nil {
+			return nil, fmt.Errorf("Invalid proxy address %q: %v", proxyEnv, err)
+		}
+	}
+
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxyUrl, nil
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme: %s", proxyUrl.Scheme)
+	}
+}
+
+// getenv returns the value of an environment variable, or of its lowercase version
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// useProxy returns whether a connection to addr should go through the proxy, given the value of NO_PROXY
+func useProxy(addr, noProxy string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	if host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return false
+	}
+
+	for _, pattern := range strings.Split(noProxy, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch {
+		case pattern == "":
+			continue
+		case pattern == "*":
+			return false
+		}
+
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+
+		// patterns may be restricted to a port
+		if patternHost, patternPort, err := net.SplitHostPort(pattern); err == nil {
+			if patternPort != port {
+				continue
+			}
+			pattern = patternHost
+		}
+
+		if patternIP := net.ParseIP(pattern); patternIP != nil {
+			if ip != nil && ip.Equal(patternIP) {
+				return false
+			}
+			continue
+		}
+
+		// example.com, .example.com and *.example.com all match example.com and its subdomains
+		domain := strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dialProxy opens a connection to addr through the proxy at proxyUrl
+func dialProxy(ctx context.Context, network string, proxyUrl *url.URL, addr string) (conn net.Conn, err error) {
+	switch proxyUrl.Scheme {
+	case "socks5", "socks5h":
+		var proxyAuth *proxy.Auth
+		if proxyUrl.User != nil {
+			password, _ := proxyUrl.User.Password()
+			proxyAuth = &proxy.Auth{User: proxyUrl.User.Username(), Password: password}
+		}
+		conn, err = socks5Connect(ctx, network, proxyUrl.Host, proxyAuth, addr)
+	default:
+		p := &HTTPProxy{URL: proxyUrl}
+		conn, err = p.DialContext(ctx, network, addr)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to %s through proxy %s: %v", addr, proxyUrl.Host, err)
+	}
+	return conn, nil
+}
+
+// clientTLS upgrades a connection to addr to TLS, verifying the server's certificate
+// against addr's host name unless tlsConfig specifies another one
+func clientTLS(ctx context.Context, conn net.Conn, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
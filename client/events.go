@@ -0,0 +1,111 @@
+package client
+
+import (
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	"time"
+)
+
+const (
+	// number of events buffered for the reader of Session.Events()
+	eventBufferSize = 64
+)
+
+// EventType identifies what happened to a session
+type EventType int
+
+const (
+	// Connecting is emitted before a ReconnectingSession dials the server
+	Connecting EventType = iota
+
+	// Connected is emitted once the server accepted the session's Auth message
+	Connected
+
+	// Disconnected is emitted when the connection to the server is lost
+	Disconnected
+
+	// Reconnecting is emitted when a ReconnectingSession failed to (re)connect
+	// and is about to wait before trying again
+	Reconnecting
+
+	// TunnelRebound is emitted when a tunnel was bound again after reconnecting
+	// and the server assigned it a different url than before
+	TunnelRebound
+
+	// PermanentFailure is emitted when a ReconnectingSession gives up
+	PermanentFailure
+
+	// TunnelClosed is emitted when the server closed one of the session's tunnels on its own
+	TunnelClosed
+
+	// GoAway is emitted when the server announced that it is about to close the session
+	GoAway
+
+	// Notice is emitted when the server sent a warning which doesn't end the session
+	Notice
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Connecting:
+		return "Connecting"
+	case Connected:
+		return "Connected"
+	case Disconnected:
+		return "Disconnected"
+	case Reconnecting:
+		return "Reconnecting"
+	case TunnelRebound:
+		return "TunnelRebound"
+	case PermanentFailure:
+		return "PermanentFailure"
+	case TunnelClosed:
+		return "TunnelClosed"
+	case GoAway:
+		return "GoAway"
+	case Notice:
+		return "Notice"
+	default:
+		return "Unknown"
+	}
+}
+
+// An Event describes a change in the state of a session's connection to the server.
+// Only the fields relevant to the event's Type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	Version      string             // Connected: the protocol version chosen by the server
+	ClientId     string             // Connected: the id the server assigned to the session
+	Capabilities proto.Capabilities // Connected: the optional protocol features negotiated with the server
+
+	Err error // Disconnected, Reconnecting, PermanentFailure: the cause, nil if the session was closed on purpose
+
+	Attempt int           // Connecting, Reconnecting: the number of the connection attempt, starting at 1
+	Delay   time.Duration // Reconnecting, GoAway: how long the session waits before the next attempt
+
+	OldUrl string // TunnelRebound: the url the tunnel was bound at before reconnecting
+	NewUrl string // TunnelRebound: the url the tunnel is bound at now
+
+	Url           string // TunnelClosed, Notice: the url of the tunnel concerned, empty for the whole session
+	Code          string // Notice: the machine-readable kind of notice, e.g. "quota"
+	Message       string // TunnelClosed, GoAway: the reason the server gave; Notice: the notice itself
+	ReconnectAddr string // GoAway: another server the server suggested to reconnect to, if any
+}
+
+// Events returns a channel of the events describing the session's connection
+// to the server. Events are buffered, but dropped if the buffer is full, so
+// the channel should be read continuously by a single reader.
+func (s *Session) Events() <-chan Event {
+	return s.events
+}
+
+// emit queues an event for the reader of Events() without blocking
+func (s *Session) emit(e Event) {
+	e.Time = time.Now()
+	select {
+	case s.events <- e:
+	default:
+		s.raw.Debug("Dropping %v event, events are not being read", e.Type)
+	}
+}
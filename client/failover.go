@@ -0,0 +1,217 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/go-tunnel/log"
+	muxado "github.com/inconshreveable/muxado"
+)
+
+const (
+	// default for FailoverDialer.Cooldown
+	defaultFailoverCooldown = 30 * time.Second
+)
+
+// TCPDialer returns a dialer for NewReconnectingSession which connects to addr
+func TCPDialer(network, addr string) func() (muxado.Session, error) {
+	return func() (muxado.Session, error) {
+		return muxado.Dial(network, addr)
+	}
+}
+
+// TLSDialer returns a dialer for NewReconnectingSession which connects to addr over TLS
+func TLSDialer(network, addr string, tlsConfig *tls.Config) func() (muxado.Session, error) {
+	return func() (muxado.Session, error) {
+		return muxado.DialTLS(network, addr, tlsConfig)
+	}
+}
+
+// An Endpoint is one of the tunnel servers a FailoverDialer may connect to
+type Endpoint struct {
+	// Name identifies the endpoint in logs and errors, e.g. its address
+	Name string
+
+	// Dial connects to the endpoint. Use TCPDialer, TLSDialer, HTTPDialer or SOCKS5Dialer
+	Dial func() (muxado.Session, error)
+
+	// Priority orders endpoints like the priority of a DNS SRV record:
+	// endpoints with a lower priority are tried first
+	Priority int
+
+	// Weight is the relative chance of an endpoint to be tried before the other
+	// endpoints with the same priority, like the weight of a DNS SRV record
+	Weight int
+}
+
+// FailoverOrder decides in what order a FailoverDialer tries its endpoints
+type FailoverOrder int
+
+const (
+	// ByPriority tries the endpoints by ascending Priority, picking among
+	// endpoints of the same priority at random according to their Weight
+	ByPriority FailoverOrder = iota
+
+	// RoundRobin starts at the next endpoint each time it dials, so that
+	// successive connections are spread over all of the endpoints
+	RoundRobin
+)
+
+// A FailoverDialer connects to the first of several tunnel servers which accepts a
+// connection, so that a ReconnectingSession can fail over from one region to another:
+//
+//	d := client.NewFailoverDialer(client.ByPriority,
+//		&client.Endpoint{Name: "us", Dial: client.TLSDialer("tcp", "us.example.com:4443", tlsConfig), Priority: 1},
+//		&client.Endpoint{Name: "eu", Dial: client.TLSDialer("tcp", "eu.example.com:4443", tlsConfig), Priority: 2},
+//	)
+//	sess, err := client.NewReconnectingSession(d.Dial, authExtra)
+//
+// Endpoints which failed recently are tried only after all of the others.
+type FailoverDialer struct {
+	log.Logger
+
+	// Cooldown is how long an endpoint which failed is tried last. Defaults to 30 seconds.
+	Cooldown time.Duration
+
+	order     FailoverOrder
+	endpoints []*Endpoint
+
+	sync.Mutex
+	next     int                     // first endpoint to try next, for RoundRobin
+	failures map[*Endpoint]time.Time // when each endpoint last failed
+	rand     *rand.Rand
+}
+
+// NewFailoverDialer creates a FailoverDialer which tries endpoints in the given order
+func NewFailoverDialer(order FailoverOrder, endpoints ...*Endpoint) *FailoverDialer {
+	for i, e := range endpoints {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("endpoint %d", i+1)
+		}
+	}
+
+	return &FailoverDialer{
+		Logger:    log.NewTaggedLogger("failover"),
+		Cooldown:  defaultFailoverCooldown,
+		order:     order,
+		endpoints: endpoints,
+		failures:  make(map[*Endpoint]time.Time),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Dial connects to the first endpoint which accepts a connection. It may be passed
+// as the dialer to NewReconnectingSession.
+func (d *FailoverDialer) Dial() (muxado.Session, error) {
+	if len(d.endpoints) == 0 {
+		return nil, errors.New("No endpoints to dial")
+	}
+
+	errs := make([]string, 0)
+	for _, e := range d.plan() {
+		mux, err := e.Dial()
+		if err == nil {
+			d.succeeded(e)
+			return mux, nil
+		}
+
+		d.Warn("Failed to dial %s: %v", e.Name, err)
+		d.failed(e)
+		errs = append(errs, fmt.Sprintf("%s: %v", e.Name, err))
+	}
+
+	return nil, fmt.Errorf("Failed to dial all endpoints: %s", strings.Join(errs, "; "))
+}
+
+// plan returns the endpoints in the order to try them
+func (d *FailoverDialer) plan() []*Endpoint {
+	d.Lock()
+	defer d.Unlock()
+
+	var ordered []*Endpoint
+	switch d.order {
+	case RoundRobin:
+		ordered = make([]*Endpoint, 0, len(d.endpoints))
+		for i := range d.endpoints {
+			ordered = append(ordered, d.endpoints[(d.next+i)%len(d.endpoints)])
+		}
+		d.next = (d.next + 1) % len(d.endpoints)
+	default:
+		ordered = d.byPriority()
+	}
+
+	// move the endpoints which failed recently to the end, keeping their order
+	healthy := make([]*Endpoint, 0, len(ordered))
+	unhealthy := make([]*Endpoint, 0)
+	for _, e := range ordered {
+		if failedAt, ok := d.failures[e]; ok && time.Since(failedAt) < d.Cooldown {
+			unhealthy = append(unhealthy, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// byPriority orders the endpoints by priority and, within each priority, by the
+// weighted random selection of RFC 2782 for DNS SRV records. The caller must hold the lock.
+func (d *FailoverDialer) byPriority() []*Endpoint {
+	groups := make(map[int][]*Endpoint)
+	priorities := make([]int, 0)
+	for _, e := range d.endpoints {
+		if _, ok := groups[e.Priority]; !ok {
+			priorities = append(priorities, e.Priority)
+		}
+		groups[e.Priority] = append(groups[e.Priority], e)
+	}
+	sort.Ints(priorities)
+
+	ordered := make([]*Endpoint, 0, len(d.endpoints))
+	for _, p := range priorities {
+		group := append([]*Endpoint{}, groups[p]...)
+		for len(group) > 0 {
+			total := 0
+			for _, e := range group {
+				total += weight(e)
+			}
+
+			// endpoints with zero weight are only picked once all of the others were,
+			// in the order they were given
+			i := 0
+			if total > 0 {
+				for pick := d.rand.Intn(total); pick >= weight(group[i]); i++ {
+					pick -= weight(group[i])
+				}
+			}
+
+			ordered = append(ordered, group[i])
+			group = append(group[:i], group[i+1:]...)
+		}
+	}
+	return ordered
+}
+
+func weight(e *Endpoint) int {
+	if e.Weight < 0 {
+		return 0
+	}
+	return e.Weight
+}
+
+func (d *FailoverDialer) failed(e *Endpoint) {
+	d.Lock()
+	defer d.Unlock()
+	d.failures[e] = time.Now()
+}
+
+func (d *FailoverDialer) succeeded(e *Endpoint) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.failures, e)
+}
@@ -2,95 +2,257 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/inconshreveable/muxado"
 	"golang.org/x/net/proxy"
 )
 
+const (
+	// how much of the body of a proxy's 407 response is read before retrying on the same connection
+	maxChallengeBody = 64 * 1024
+)
+
+// the proxy dialers refuse to run a session in plaintext by accident
+var errNoTLSConfig = errors.New("No TLS config for the connection to the tunnel server")
+
+// SOCKS5Dialer returns a dialer for NewReconnectingSession which connects to addr over TLS
+// through the SOCKS5 proxy at proxyAddr. tlsConfig must not be nil.
 func SOCKS5Dialer(network, proxyAddr, user, password, addr string, tlsConfig *tls.Config) func() (muxado.Session, error) {
 	return func() (muxado.Session, error) {
+		if tlsConfig == nil {
+			return nil, errNoTLSConfig
+		}
+
 		proxyAuth := &proxy.Auth{User: user, Password: password}
 
-		proxyDialer, err := proxy.SOCKS5(network, proxyAddr, proxyAuth, proxy.Direct)
+		ctx := context.Background()
+		conn, err := socks5Connect(ctx, network, proxyAddr, proxyAuth, addr)
 		if err != nil {
 			return nil, err
 		}
 
-		conn, err := proxyDialer.Dial("tcp", addr)
-		if err != nil {
+		// upgrade to TLS
+		if conn, err = clientTLS(ctx, conn, addr, tlsConfig); err != nil {
 			return nil, err
 		}
 
-		// upgrade to TLS
-		conn = tls.Client(conn, tlsConfig)
-
 		return muxado.Client(conn), nil
 	}
 }
 
+// HTTPDialer returns a dialer for NewReconnectingSession which connects to addr over TLS
+// through the HTTP proxy at proxyUrl. tlsConfig must not be nil. The connection to the
+// proxy itself only uses TLS for https:// proxy URLs. Use an HTTPProxy to configure the
+// proxy further, or to run the session in plaintext.
 func HTTPDialer(network, proxyUrl, addr string, tlsConfig *tls.Config) func() (muxado.Session, error) {
-	return func() (sess muxado.Session, err error) {
-		// parse the proxy address
-		var parsedUrl *url.URL
-		if parsedUrl, err = url.Parse(proxyUrl); err != nil {
-			return
+	return func() (muxado.Session, error) {
+		parsedUrl, err := url.Parse(proxyUrl)
+		if err != nil {
+			return nil, err
 		}
 
-		var proxyAuth string
-		if parsedUrl.User != nil {
-			proxyAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(parsedUrl.User.String()))
+		p := &HTTPProxy{URL: parsedUrl}
+		return p.Dialer(network, addr, tlsConfig)()
+	}
+}
+
+// An HTTPProxy connects to addresses through an HTTP proxy with CONNECT requests
+type HTTPProxy struct {
+	// URL is the address of the proxy, http://host:port or https://host:port. Its user
+	// and password, if any, are only sent once the proxy asks for them, with Basic or
+	// Digest authentication as the proxy's challenge requires.
+	URL *url.URL
+
+	// TLSConfig configures the TLS connection to an https:// proxy. If nil, the proxy's
+	// certificate is verified against the host name in URL.
+	TLSConfig *tls.Config
+
+	// Header holds extra headers to send with the CONNECT requests, e.g. a User-Agent
+	Header http.Header
+}
+
+// Dialer returns a dialer for NewReconnectingSession which connects to addr over TLS through
+// the proxy. tlsConfig must not be nil.
+func (p *HTTPProxy) Dialer(network, addr string, tlsConfig *tls.Config) func() (muxado.Session, error) {
+	return func() (muxado.Session, error) {
+		if tlsConfig == nil {
+			return nil, errNoTLSConfig
 		}
 
-		var dial func(net, addr string) (net.Conn, error)
-		switch parsedUrl.Scheme {
-		case "http":
-			dial = net.Dial
-		case "https":
-			dial = func(net, addr string) (net.Conn, error) { return tls.Dial(net, addr, new(tls.Config)) }
-		default:
-			err = fmt.Errorf("Proxy URL scheme must be http or https, got: %s", parsedUrl.Scheme)
-			return
+		ctx := context.Background()
+		conn, err := p.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
 		}
 
-		// dial the proxy
-		var conn net.Conn
-		if conn, err = dial(network, parsedUrl.Host); err != nil {
-			return
+		if conn, err = clientTLS(ctx, conn, addr, tlsConfig); err != nil {
+			return nil, err
 		}
 
-		// send an HTTP proxy CONNECT message
-		req, err := http.NewRequest("CONNECT", "https://"+addr, nil)
+		return muxado.Client(conn), nil
+	}
+}
+
+// PlaintextDialer returns a dialer for NewReconnectingSession which connects to addr through
+// the proxy without TLS. Only use it for servers which don't listen for TLS connections.
+func (p *HTTPProxy) PlaintextDialer(network, addr string) func() (muxado.Session, error) {
+	return func() (muxado.Session, error) {
+		conn, err := p.DialContext(context.Background(), network, addr)
 		if err != nil {
-			return
+			return nil, err
 		}
+		return muxado.Client(conn), nil
+	}
+}
 
-		if proxyAuth != "" {
-			req.Header.Set("Proxy-Authorization", proxyAuth)
-		}
-		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ngrok)")
-		req.Write(conn)
+// DialContext opens a connection to addr through the proxy. network is used to connect to the proxy.
+// The proxy's credentials are only sent in answer to its challenge.
+func (p *HTTPProxy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, br, resp, err := p.connect(ctx, network, nil, addr, "")
+	if err != nil {
+		return nil, err
+	}
 
-		// read the proxy's response
-		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if resp.StatusCode == http.StatusProxyAuthRequired && p.URL.User != nil {
+		password, _ := p.URL.User.Password()
+		proxyAuth, err := proxyAuthorization(resp.Header, p.URL.User.Username(), password, "CONNECT", addr)
 		if err != nil {
-			return
+			resp.Body.Close()
+			conn.Close()
+			return nil, err
+		}
+
+		// retry on the same connection unless the proxy closes it
+		if resp.Close || !drain(resp) {
+			conn.Close()
+			conn, br = nil, nil
 		}
-		resp.Body.Close()
 
-		if resp.StatusCode != 200 {
-			err = fmt.Errorf("Non-200 response from proxy server: %s", resp.Status)
+		if conn, br, resp, err = p.connect(ctx, network, conn, addr, proxyAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Non-200 response from proxy server: %s", resp.Status)
+	}
+
+	// the reader may hold bytes the server sent right after the proxy's response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// connect sends a CONNECT request for addr on conn, or on a new connection to the proxy if
+// conn is nil, and reads the proxy's response. The connection is closed if it fails.
+func (p *HTTPProxy) connect(ctx context.Context, network string, conn net.Conn, addr, proxyAuth string) (_ net.Conn, br *bufio.Reader, resp *http.Response, err error) {
+	if conn == nil {
+		if conn, err = p.dial(ctx, network); err != nil {
 			return
 		}
+	}
 
-		// upgrade to TLS
-		conn = tls.Client(conn, tlsConfig)
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
 
-		return muxado.Client(conn), nil
+	// give up on the CONNECT request once ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
 	}
+	for k, v := range p.Header {
+		req.Header[k] = v
+	}
+	if proxyAuth != "" {
+		req.Header.Set("Proxy-Authorization", proxyAuth)
+	}
+
+	if err = req.Write(conn); err != nil {
+		return
+	}
+
+	br = bufio.NewReader(conn)
+	if resp, err = http.ReadResponse(br, req); err != nil {
+		return
+	}
+	return conn, br, resp, nil
+}
+
+// dial opens a connection to the proxy
+func (p *HTTPProxy) dial(ctx context.Context, network string) (net.Conn, error) {
+	switch p.URL.Scheme {
+	case "http":
+		var d net.Dialer
+		return d.DialContext(ctx, network, p.URL.Host)
+	case "https":
+		d := &tls.Dialer{Config: p.TLSConfig}
+		return d.DialContext(ctx, network, p.URL.Host)
+	default:
+		return nil, fmt.Errorf("Proxy URL scheme must be http or https, got: %s", p.URL.Scheme)
+	}
+}
+
+// drain reads the rest of a response's body so that the connection can be reused,
+// and returns false if it can't be
+func drain(resp *http.Response) bool {
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxChallengeBody+1))
+	return err == nil && n <= maxChallengeBody
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// bufferedConn is a connection whose first bytes were already read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socks5Connect opens a connection to addr through the SOCKS5 proxy at proxyAddr
+func socks5Connect(ctx context.Context, network, proxyAddr string, proxyAuth *proxy.Auth, addr string) (net.Conn, error) {
+	proxyDialer, err := proxy.SOCKS5(network, proxyAddr, proxyAuth, contextDialer{ctx})
+	if err != nil {
+		return nil, err
+	}
+
+	return proxyDialer.Dial("tcp", addr)
+}
+
+// contextDialer dials the connections to a SOCKS5 proxy, giving up once ctx is done
+type contextDialer struct {
+	ctx context.Context
+}
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(d.ctx, network, addr)
 }
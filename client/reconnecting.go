@@ -1,38 +1,80 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/inconshreveable/go-tunnel/conn"
 	"github.com/inconshreveable/go-tunnel/proto"
 	"github.com/inconshreveable/muxado"
-	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	maxWait = 30 * time.Second
-)
-
 // This is a raw session object that has two important properties:
 // 1. if a call to accept would have failed, it initiates a reconnect attempt instead
 // 2. in order to facilitate the reconnect, it protects the RawSession's mux and allows it to be swapped out
 type reconnectingRaw struct {
 	*RawSession
 	sync.RWMutex
-	reconnect func() error
+	reconnect func(cause error) error
+	ready     bool // set once the current connection is authenticated
 }
 
 func (s *reconnectingRaw) Listen(protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
+	return s.ListenContext(context.Background(), protocol, opts, extra)
+}
+
+func (s *reconnectingRaw) ListenContext(ctx context.Context, protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.RawSession.ListenContext(ctx, protocol, opts, extra)
+}
+
+func (s *reconnectingRaw) Relisten(url, protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
+	return s.RelistenContext(context.Background(), url, protocol, opts, extra)
+}
+
+func (s *reconnectingRaw) RelistenContext(ctx context.Context, url, protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
 	s.RLock()
 	defer s.RUnlock()
-	return s.RawSession.Listen(protocol, opts, extra)
+	return s.RawSession.RelistenContext(ctx, url, protocol, opts, extra)
 }
 
 func (s *reconnectingRaw) Unlisten(url string) (resp *proto.UnbindResp, err error) {
+	return s.UnlistenContext(context.Background(), url)
+}
+
+func (s *reconnectingRaw) UnlistenContext(ctx context.Context, url string) (resp *proto.UnbindResp, err error) {
 	s.RLock()
 	defer s.RUnlock()
-	return s.RawSession.Unlisten(url)
+	return s.RawSession.UnlistenContext(ctx, url)
+}
+
+func (s *reconnectingRaw) PingContext(ctx context.Context) (time.Duration, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.RawSession.PingContext(ctx)
+}
+
+// heartbeat pings the server over the current connection, which is closed if the server
+// doesn't answer. The lock guarantees that a newer connection isn't closed instead.
+func (s *reconnectingRaw) heartbeat(ctx context.Context) (time.Duration, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	// a ping must not reach the server before the Auth message
+	if !s.ready {
+		return 0, errors.New("Not connected")
+	}
+	return s.RawSession.heartbeat(ctx)
+}
+
+func (s *reconnectingRaw) Close() error {
+	s.RLock()
+	defer s.RUnlock()
+	return s.RawSession.Close()
 }
 
 func (s *reconnectingRaw) Accept() (conn.Conn, error) {
@@ -46,7 +88,7 @@ func (s *reconnectingRaw) Accept() (conn.Conn, error) {
 		if err != nil {
 			s.Error("Error from Accept(): %v, reconnecting . . .", err)
 			// reconnect can still return errors for permanent failures
-			if err = s.reconnect(); err != nil {
+			if err = s.reconnect(err); err != nil {
 				return nil, err
 			}
 		} else {
@@ -60,16 +102,35 @@ type ReconnectingSession struct {
 	authExtra interface{}
 	done      chan error
 	raw       *reconnectingRaw
+	ctx       context.Context // closes the session when done
+	stopped   chan struct{}   // closed once the session fails permanently
+	backoff   *backoff        // applies the ReconnectPolicy
 	*Session
 }
 
+// NewReconnectingSession starts a session over a connection created with dialer which
+// reconnects with the DefaultReconnectPolicy whenever the connection is lost.
 func NewReconnectingSession(dialer func() (muxado.Session, error), authExtra interface{}) (*ReconnectingSession, error) {
+	return NewReconnectingSessionContext(context.Background(), dialer, authExtra, nil)
+}
+
+// NewReconnectingSessionContext is like NewReconnectingSession, but reconnects according to
+// policy, which may be nil for the DefaultReconnectPolicy. Once ctx is done, the session is
+// closed and Wait returns the context's error. If ctx is done before the session first
+// connects, NewReconnectingSessionContext returns the context's error.
+func NewReconnectingSessionContext(ctx context.Context, dialer func() (muxado.Session, error), authExtra interface{}, policy *ReconnectPolicy) (*ReconnectingSession, error) {
 	s := &ReconnectingSession{
 		dialer:    dialer,
 		done:      make(chan error, 1),
 		authExtra: authExtra,
+		ctx:       ctx,
+		stopped:   make(chan struct{}),
+		backoff:   newBackoff(policy),
 		Session: &Session{
-			tunnels: make(map[string]*Tunnel),
+			tunnels:  make(map[string]*Tunnel),
+			events:   make(chan Event, eventBufferSize),
+			managed:  true,
+			shutdown: make(chan struct{}),
 		},
 		raw: &reconnectingRaw{RawSession: NewRawSession(nil)},
 	}
@@ -79,79 +140,192 @@ func NewReconnectingSession(dialer func() (muxado.Session, error), authExtra int
 	s.Session.raw = s.raw
 
 	// setup an initial connection before we return
-	if err := s.reconnect(); err != nil {
+	if err := s.reconnect(nil); err != nil {
 		return nil, err
 	}
 
 	go s.Session.receive()
+	go s.closeWhenDone()
 
 	return s, nil
 }
 
-func (s *ReconnectingSession) reconnect() error {
-	var wait time.Duration = time.Second
+// closeWhenDone closes the connection to the server once the session's context is done,
+// which makes the session fail permanently instead of reconnecting
+func (s *ReconnectingSession) closeWhenDone() {
+	select {
+	case <-s.ctx.Done():
+		s.raw.RLock()
+		s.raw.mux.Close()
+		s.raw.RUnlock()
+	case <-s.stopped:
+	}
+}
 
-	failTemp := func(err error) {
-		s.raw.Info("Session failed: %v", err)
+// reconnect establishes a new connection to the server and binds all of the
+// session's tunnels again. cause is the error the previous connection failed
+// with, nil for the initial connection.
+func (s *ReconnectingSession) reconnect(cause error) error {
+	// the session was closed on purpose, so Wait reports success
+	stop := func() error {
+		close(s.stopped)
+		s.done <- nil
+		return errors.New("Session closed")
+	}
 
-		// session failed, wait before reconnecting
-		s.raw.Info("Waiting %d seconds before reconnecting", int(wait.Seconds()))
-		time.Sleep(wait)
+	if s.isClosing() {
+		s.emit(Event{Type: Disconnected})
+		return stop()
+	}
 
-		// exponentially increase wait time up to a limit
-		wait = 2 * wait
-		wait = time.Duration(math.Min(float64(wait), float64(maxWait)))
+	if cause != nil {
+		s.emit(Event{Type: Disconnected, Err: cause})
 	}
 
 	fail := func(err error) error {
+		s.emit(Event{Type: PermanentFailure, Err: err})
+		close(s.stopped)
 		s.done <- err
 		return err
 	}
 
+	// sleep waits before the next attempt unless the session is closed first
+	sleep := func(wait time.Duration) error {
+		s.raw.Info("Waiting %v before reconnecting", wait)
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return nil
+		case <-s.ctx.Done():
+			return fail(s.ctx.Err())
+		case <-s.shutdown:
+			return stop()
+		}
+	}
+
+	// failTemp waits before the next attempt. It returns an error
+	// if the session should not be reconnected anymore.
+	failTemp := func(err error) error {
+		s.raw.Info("Session failed: %v", err)
+		if s.backoff.IsPermanent(err) {
+			return fail(err)
+		}
+
+		wait, ok := s.backoff.next()
+		if !ok {
+			return fail(fmt.Errorf("Giving up reconnecting after %d attempts in %v: %v", s.backoff.attempts, time.Since(s.backoff.start).Round(time.Millisecond), err))
+		}
+		s.emit(Event{Type: Reconnecting, Err: err, Attempt: s.backoff.attempts, Delay: wait})
+
+		// session failed, wait before reconnecting
+		return sleep(wait)
+	}
+
+	// the server may have asked to wait before reconnecting when it closed the session
+	if delay := time.Duration(atomic.SwapInt64(&s.goAwayDelay, 0)); delay > 0 {
+		if err := sleep(delay); err != nil {
+			return err
+		}
+	}
+
 retry:
+	if err := s.ctx.Err(); err != nil {
+		return fail(err)
+	}
+	if s.isClosing() {
+		return stop()
+	}
+	s.emit(Event{Type: Connecting, Attempt: s.backoff.attempts + 1})
+
 	// dial the tunnel server
 	mux, err := s.dialer()
 	if err != nil {
-		failTemp(err)
+		if err = failTemp(err); err != nil {
+			return err
+		}
 		goto retry
 	}
 
 	// swap the muxado session in
 	s.raw.Lock()
-	s.raw.mux = mux
+	s.raw.mux, s.raw.ready = mux, false
 	s.raw.Unlock()
 
-	resp, err := s.raw.Auth(s.raw.id, s.authExtra)
+	// Close may have missed the new connection
+	if s.isClosing() {
+		mux.Close()
+		return stop()
+	}
+
+	resp, err := s.raw.AuthContext(s.ctx, s.raw.clientId(), s.authExtra)
+	if err == nil && resp.Error != "" {
+		err = &ServerError{Msg: resp.Error}
+	}
 	if err != nil {
-		failTemp(err)
+		mux.Close()
+		if err = failTemp(err); err != nil {
+			return err
+		}
 		goto retry
 	}
 
-	// auth errors are considered permanent
-	if resp.Error != "" {
-		return fail(errors.New(resp.Error))
-	}
+	s.raw.Lock()
+	s.raw.ready = true
+	s.raw.Unlock()
 
 	// re-establish binds
 	s.RLock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
 	for _, t := range s.tunnels {
-		resp, err := s.raw.Listen(t.proto, t.bindOpts, t.bindExtra)
+		tunnels = append(tunnels, t)
+	}
+	s.RUnlock()
+
+	for _, t := range tunnels {
+		bindResp, err := s.raw.RelistenContext(s.ctx, t.url, t.proto, t.bindOpts, t.bindExtra)
+		if err == nil && bindResp.Error != "" {
+			err = &ServerError{Msg: bindResp.Error}
+		}
 		if err != nil {
-			s.RUnlock()
-			failTemp(err)
+			mux.Close()
+			if err = failTemp(err); err != nil {
+				return err
+			}
 			goto retry
 		}
 
-		if resp.Error != "" {
-			s.RUnlock()
-			return fail(errors.New(resp.Error))
+		if bindResp.Url != t.url {
+			s.rebind(t, bindResp)
 		}
 	}
-	s.RUnlock()
 
+	s.backoff.reset()
+	s.emit(Event{Type: Connected, Version: resp.Version, ClientId: resp.ClientId, Capabilities: resp.Capabilities})
 	return nil
 }
 
+// Heartbeat is like Session.Heartbeat, but keeps pinging the server over every
+// new connection after reconnecting until the session is closed or gives up.
+func (s *ReconnectingSession) Heartbeat(interval, timeout time.Duration) {
+	go s.heartbeat(interval, timeout, s.stopped)
+}
+
+// rebind moves a tunnel to the url the server bound it at after reconnecting
+func (s *ReconnectingSession) rebind(t *Tunnel, resp *proto.BindResp) {
+	s.Lock()
+	oldUrl := t.url
+	delete(s.tunnels, oldUrl)
+	t.url, t.bindResp = resp.Url, resp
+	s.tunnels[t.url] = t
+	s.Unlock()
+
+	s.raw.Warn("Tunnel %s was bound again at %s", oldUrl, t.url)
+	s.emit(Event{Type: TunnelRebound, OldUrl: oldUrl, NewUrl: t.url})
+}
+
+// Wait blocks until the session gives up reconnecting and returns the reason.
+// It returns nil if the session was closed with Close or Shutdown.
 func (s *ReconnectingSession) Wait() error {
 	return <-s.done
 }
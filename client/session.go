@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"errors"
 	conn "github.com/inconshreveable/go-tunnel/conn"
 	log "github.com/inconshreveable/go-tunnel/log"
@@ -10,25 +11,45 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// how often Shutdown checks whether all proxied connections have finished
+	shutdownPollInterval = 500 * time.Millisecond
 )
 
 type rawSession interface {
-	Auth(string, interface{}) (*proto.AuthResp, error)
-	Listen(string, interface{}, interface{}) (*proto.BindResp, error)
-	Unlisten(string) (*proto.UnbindResp, error)
+	AuthContext(context.Context, string, interface{}) (*proto.AuthResp, error)
+	ListenContext(context.Context, string, interface{}, interface{}) (*proto.BindResp, error)
+	UnlistenContext(context.Context, string) (*proto.UnbindResp, error)
 	Accept() (conn.Conn, error)
+	Close() error
+	heartbeat(context.Context) (time.Duration, error)
+	Capabilities() proto.Capabilities
+	Codec() proto.Codec
 	log.Logger
 }
 
+// errNoHeartbeat is returned when pinging a server which can't answer pings
+var errNoHeartbeat = errors.New("Server does not support heartbeats")
+
 // A RawSession is a client session which handles authorization with the tunnel server, then
 // listening and unlistening of tunnels.
 //
 // When RawSession.Accept() returns an error, that means the session is dead.
 // Client sessions run over a muxado session.
 type RawSession struct {
-	mux        muxado.Session // the muxado session we're multiplexing streams over
-	log.Logger                // logger for this client
-	id         string         // session id, allows for resuming existing sessions
+	mux          muxado.Session     // the muxado session we're multiplexing streams over
+	log.Logger                      // logger for this client
+	id           string             // session id, allows for resuming existing sessions
+	resumeToken  string             // secret proving ownership of the session id when resuming
+	capabilities proto.Capabilities // optional protocol features negotiated with the server
+	codec        proto.Codec        // encodes the messages following the auth response
+
+	// guards id, resumeToken, capabilities and codec, which change on every successful Auth
+	state sync.RWMutex
 }
 
 // Creates a new client tunnel session with the given id
@@ -37,57 +58,162 @@ func NewRawSession(mux muxado.Session) *RawSession {
 	sess := &RawSession{
 		mux:    mux,
 		Logger: log.NewTaggedLogger("session"),
+		codec:  proto.JSON,
 	}
 
 	return sess
 }
 
 // Auth sends an authentication message to the server and returns the server's response.
-// The id string will be empty unless reconnecting an existing session.
+// The id string will be empty unless reconnecting an existing session. When reconnecting
+// with the id of the session this RawSession previously authenticated, the resume token
+// the server issued for it is sent along automatically.
 // extra is an opaque struct useful for passing application-specific data.
 func (s *RawSession) Auth(id string, extra interface{}) (resp *proto.AuthResp, err error) {
+	return s.AuthContext(context.Background(), id, extra)
+}
+
+// AuthContext is like Auth, but gives up waiting for the server's response once ctx is done
+func (s *RawSession) AuthContext(ctx context.Context, id string, extra interface{}) (resp *proto.AuthResp, err error) {
 	req := &proto.Auth{
-		ClientId: id,
-		Extra:    extra,
-		Version:  []string{proto.Version},
+		ClientId:     id,
+		Extra:        extra,
+		Version:      proto.Versions,
+		Capabilities: proto.Supported,
 	}
+	s.state.RLock()
+	if id != "" && id == s.id {
+		req.ResumeToken = s.resumeToken
+	}
+	s.state.RUnlock()
+
 	resp = new(proto.AuthResp)
-	if err = s.req("auth", req, resp); err != nil {
+	// the codec is only negotiated by the auth response
+	if err = s.req(ctx, "auth", proto.JSON, req, resp); err != nil {
 		return
 	}
 
+	if resp.Error != "" {
+		return
+	}
+
+	if resp.Extra, err = proto.DecodeExtra(proto.AuthRespExtra, resp.Extra); err != nil {
+		return
+	}
+
+	s.state.Lock()
+	defer s.state.Unlock()
+
 	// set client id / log tag only if it changed
 	if s.id != resp.ClientId {
 		s.id = resp.ClientId
 		s.Logger.AddTags(s.id)
 	}
+	s.resumeToken = resp.ResumeToken
+	s.capabilities = resp.Capabilities
+	s.codec = proto.NegotiatedCodec(resp.Capabilities)
 	return
 }
 
+// clientId returns the id the server assigned to the session in the latest successful Auth
+func (s *RawSession) clientId() string {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	return s.id
+}
+
+// Capabilities returns the optional protocol features both the client and the server
+// support, as negotiated by the latest successful Auth. Servers which predate capability
+// negotiation support none. The returned map must not be modified.
+func (s *RawSession) Capabilities() proto.Capabilities {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	return s.capabilities
+}
+
+// Codec returns the codec of the messages exchanged with the server after the latest
+// successful Auth
+func (s *RawSession) Codec() proto.Codec {
+	s.state.RLock()
+	defer s.state.RUnlock()
+	return s.codec
+}
+
 // Listen sends a listen message to the server and returns the server's response
 // protocol is the requested protocol to listen.
 // opts are protocol-specific options for listening.
 // extra is an opaque struct useful for passing application-specific data.
 func (s *RawSession) Listen(protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
+	return s.RelistenContext(context.Background(), "", protocol, opts, extra)
+}
+
+// ListenContext is like Listen, but gives up waiting for the server's response once ctx is done
+func (s *RawSession) ListenContext(ctx context.Context, protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
+	return s.RelistenContext(ctx, "", protocol, opts, extra)
+}
+
+// Relisten is like Listen, but is used after reconnecting a session to bind a tunnel again.
+// url is the url the tunnel was bound at before the session disconnected. If the server kept
+// the tunnel bound while the client was away, it resumes it instead of binding a new one.
+func (s *RawSession) Relisten(url, protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
+	return s.RelistenContext(context.Background(), url, protocol, opts, extra)
+}
+
+// RelistenContext is like Relisten, but gives up waiting for the server's response once ctx is done
+func (s *RawSession) RelistenContext(ctx context.Context, url, protocol string, opts interface{}, extra interface{}) (resp *proto.BindResp, err error) {
 	req := &proto.Bind{
-		Protocol: protocol,
-		Options:  opts,
-		Extra:    extra,
+		Protocol:  protocol,
+		Options:   opts,
+		Extra:     extra,
+		ResumeUrl: url,
 	}
 	resp = new(proto.BindResp)
-	err = s.req("listen", req, resp)
+	if err = s.req(ctx, "listen", s.Codec(), req, resp); err != nil {
+		return
+	}
+	resp.Extra, err = proto.DecodeExtra(proto.BindRespExtra, resp.Extra)
 	return
 }
 
 // Unlisten sends an unlisten message to the server and returns the server's response.
 // url is the url of the open, bound tunnel to unlisten
 func (s *RawSession) Unlisten(url string) (resp *proto.UnbindResp, err error) {
+	return s.UnlistenContext(context.Background(), url)
+}
+
+// UnlistenContext is like Unlisten, but gives up waiting for the server's response once ctx is done
+func (s *RawSession) UnlistenContext(ctx context.Context, url string) (resp *proto.UnbindResp, err error) {
 	req := &proto.Unbind{Url: url}
 	resp = new(proto.UnbindResp)
-	err = s.req("unlisten", req, resp)
+	if err = s.req(ctx, "unlisten", s.Codec(), req, resp); err != nil {
+		return
+	}
+	resp.Extra, err = proto.DecodeExtra(proto.UnbindRespExtra, resp.Extra)
 	return
 }
 
+// PingContext sends a Ping to the server and returns how long it took to answer
+func (s *RawSession) PingContext(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	if err := s.req(ctx, "ping", s.Codec(), &proto.Ping{}, new(proto.Pong)); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// heartbeat pings the server and closes the connection if it doesn't answer
+func (s *RawSession) heartbeat(ctx context.Context) (time.Duration, error) {
+	if !s.Capabilities().Has(proto.CapHeartbeat) {
+		return 0, errNoHeartbeat
+	}
+
+	rtt, err := s.PingContext(ctx)
+	if err != nil {
+		s.mux.Close()
+	}
+	return rtt, err
+}
+
 // Accept returns the next stream initiated by the server over the underlying muxado session
 func (s *RawSession) Accept() (conn.Conn, error) {
 	raw, err := s.mux.Accept()
@@ -95,26 +221,62 @@ func (s *RawSession) Accept() (conn.Conn, error) {
 		return nil, err
 	}
 
-	return conn.Wrap(raw, "proxy", s.id), nil
+	return conn.Wrap(raw, "proxy", s.clientId()), nil
+}
+
+// Close closes the underlying muxado session
+func (s *RawSession) Close() error {
+	return s.mux.Close()
 }
 
-func (s *RawSession) req(tag string, req interface{}, resp interface{}) (err error) {
+// req sends a request on a new stream and reads the response. The stream's
+// deadline is the deadline of ctx and the stream is closed if ctx is done first.
+func (s *RawSession) req(ctx context.Context, tag string, codec proto.Codec, req interface{}, resp interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
 	stream, err := s.mux.Open()
 	if err != nil {
 		return
 	}
 	defer stream.Close()
 
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = stream.SetDeadline(deadline); err != nil {
+			return
+		}
+	}
+
+	// unblock reads and writes when ctx is canceled
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-finished:
+		}
+	}()
+
+	// report the context's error rather than the one from the closed stream
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
 	// log what happens on the stream
-	c := conn.Wrap(stream, tag, s.id)
+	c := conn.Wrap(stream, tag, s.clientId())
 
 	// send the unlisten request
-	if err = proto.WriteMsg(c, req); err != nil {
+	if err = proto.WriteMsgCodec(c, codec, req); err != nil {
 		return
 	}
 
 	// read out the unlisten response
-	if err = proto.ReadMsgInto(c, resp); err != nil {
+	reader := proto.MsgReader{Codec: codec}
+	if err = reader.ReadMsgInto(c, resp); err != nil {
 		return
 	}
 
@@ -130,12 +292,23 @@ type Session struct {
 	raw rawSession
 	sync.RWMutex
 	tunnels map[string]*Tunnel
+	events  chan Event // see Events()
+	managed bool       // set when a ReconnectingSession reports the connection state instead
+
+	closing  int32         // set once Close or Shutdown is called
+	shutdown chan struct{} // closed once Close or Shutdown is called
+	conns    int64         // proxied connections delivered to the application and not yet closed
+
+	goAwayDelay int64 // how long the server asked to wait before reconnecting, in nanoseconds
+	latency     int64 // round trip time of the latest heartbeat, in nanoseconds
 }
 
 func NewSession(mux muxado.Session) *Session {
 	s := &Session{
-		raw:     NewRawSession(mux),
-		tunnels: make(map[string]*Tunnel),
+		raw:      NewRawSession(mux),
+		tunnels:  make(map[string]*Tunnel),
+		events:   make(chan Event, eventBufferSize),
+		shutdown: make(chan struct{}),
 	}
 
 	go s.receive()
@@ -143,7 +316,12 @@ func NewSession(mux muxado.Session) *Session {
 }
 
 func (s *Session) Auth(id string, extra interface{}) error {
-	resp, err := s.raw.Auth(id, extra)
+	return s.AuthContext(context.Background(), id, extra)
+}
+
+// AuthContext is like Auth, but gives up waiting for the server's response once ctx is done
+func (s *Session) AuthContext(ctx context.Context, id string, extra interface{}) error {
+	resp, err := s.raw.AuthContext(ctx, id, extra)
 	if err != nil {
 		return err
 	}
@@ -152,6 +330,7 @@ func (s *Session) Auth(id string, extra interface{}) error {
 		return errors.New(resp.Error)
 	}
 
+	s.emit(Event{Type: Connected, Version: resp.Version, ClientId: resp.ClientId, Capabilities: resp.Capabilities})
 	return nil
 }
 
@@ -162,7 +341,12 @@ func (s *Session) Auth(id string, extra interface{}) error {
 // Applications will typically prefer to call the protocol-specific methods like
 // ListenHTTP, ListenTCP, etc.
 func (s *Session) Listen(protocol string, opts interface{}, extra interface{}) (*Tunnel, error) {
-	resp, err := s.raw.Listen(protocol, opts, extra)
+	return s.ListenContext(context.Background(), protocol, opts, extra)
+}
+
+// ListenContext is like Listen, but gives up waiting for the server's response once ctx is done
+func (s *Session) ListenContext(ctx context.Context, protocol string, opts interface{}, extra interface{}) (*Tunnel, error) {
+	resp, err := s.raw.ListenContext(ctx, protocol, opts, extra)
 	if err != nil {
 		return nil, err
 	}
@@ -199,6 +383,7 @@ func (s *Session) Listen(protocol string, opts interface{}, extra interface{}) (
 		bindResp:  resp,
 		sess:      s,
 		accept:    make(chan conn.Conn),
+		done:      make(chan struct{}),
 		proto:     protocol,
 	}
 
@@ -246,18 +431,167 @@ func (s *Session) ListenTLS(opts *proto.TLSOptions, extra interface{}) (*Tunnel,
 	return s.Listen("tls", opts, extra)
 }
 
-func (s *Session) receive() {
-	handleProxy := func(proxy conn.Conn) {
-		// read out the proxy message
-		var startPxy proto.StartProxy
-		if err := proto.ReadMsgInto(proxy, &startPxy); err != nil {
-			proxy.Error("Server failed to write StartProxy: %v", err)
-			proxy.Close()
+// ListenAndForward listens a new tunnel like Listen and forwards the connections it
+// accepts to localAddr like Tunnel.ForwardTo. The tunnel is closed when ctx is done.
+func (s *Session) ListenAndForward(ctx context.Context, protocol string, opts interface{}, extra interface{}, network, localAddr string) error {
+	t, err := s.ListenContext(ctx, protocol, opts, extra)
+	if err != nil {
+		return err
+	}
+
+	err = t.ForwardTo(ctx, network, localAddr)
+	if ctx.Err() != nil {
+		t.Close()
+	}
+	return err
+}
+
+// Close closes every tunnel of the session, asking the server to unbind them one after
+// another, then closes the connection to the server. Unlike Shutdown, it does not wait for
+// proxied connections to finish. A ReconnectingSession does not reconnect after Close
+// and its Wait method returns nil.
+func (s *Session) Close() error {
+	return s.close(context.Background(), false)
+}
+
+// Shutdown is like Close, but waits for all of the proxied connections accepted from
+// the session's tunnels to be closed before closing the connection to the server.
+// If ctx is done first, the connection is closed anyway and Shutdown returns the
+// context's error.
+func (s *Session) Shutdown(ctx context.Context) error {
+	return s.close(ctx, true)
+}
+
+func (s *Session) close(ctx context.Context, wait bool) (err error) {
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return errors.New("Session already closed")
+	}
+	close(s.shutdown)
+
+	s.RLock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.RUnlock()
+
+	// unlisten the tunnels first so that no new connections arrive
+	for _, t := range tunnels {
+		if ctx.Err() != nil {
+			t.close(ctx, false)
+			continue
+		}
+		if tunnelErr := t.close(ctx, true); tunnelErr != nil {
+			s.raw.Warn("Failed to unlisten tunnel %s: %v", t.url, tunnelErr)
+		}
+	}
+
+	if wait {
+		err = s.waitIdle(ctx)
+	}
+
+	if closeErr := s.raw.Close(); err == nil {
+		err = closeErr
+	}
+
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// waitIdle waits until all proxied connections are closed or ctx is done
+func (s *Session) waitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&s.conns) > 0 {
+		s.raw.Info("Waiting for %d proxied connections to finish", atomic.LoadInt64(&s.conns))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Heartbeat makes the session ping the server every interval to detect a connection
+// which died silently, e.g. because a NAT mapping expired. If the server doesn't answer
+// within timeout, which defaults to interval, the connection is closed as if it had
+// failed, so a ReconnectingSession reconnects. Call it once the session is authenticated.
+// Servers which don't support heartbeats, see Capabilities, aren't pinged.
+func (s *Session) Heartbeat(interval, timeout time.Duration) {
+	go s.heartbeat(interval, timeout, s.shutdown)
+}
+
+// heartbeat pings the server every interval until stop is closed
+func (s *Session) heartbeat(interval, timeout time.Duration, stop <-chan struct{}) {
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
 			return
 		}
 
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		rtt, err := s.raw.heartbeat(ctx)
+		cancel()
+
+		if err == errNoHeartbeat {
+			// a ReconnectingSession may connect to a server which does support them
+			if !s.managed {
+				s.raw.Warn("%v, not pinging it", err)
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			if s.isClosing() {
+				return
+			}
+			s.raw.Warn("Server missed heartbeat: %v", err)
+
+			// only a ReconnectingSession gets another connection to ping
+			if !s.managed {
+				return
+			}
+			continue
+		}
+		atomic.StoreInt64(&s.latency, int64(rtt))
+	}
+}
+
+// Latency returns the round trip time of the latest heartbeat the server
+// answered, or zero if it hasn't answered any yet. See Heartbeat.
+func (s *Session) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+// Capabilities returns the optional protocol features negotiated with the server
+// the session is connected to. The returned map must not be modified.
+func (s *Session) Capabilities() proto.Capabilities {
+	return s.raw.Capabilities()
+}
+
+func (s *Session) isClosing() bool {
+	return atomic.LoadInt32(&s.closing) == 1
+}
+
+func (s *Session) receive() {
+	handleProxy := func(proxy conn.Conn, startPxy *proto.StartProxy) {
 		// wrap connection so that it has a proper RemoteAddr()
-		proxy = &proxyConn{Conn: proxy, remoteAddr: &proxyAddr{startPxy.ClientAddr}}
+		// and is counted until it's closed
+		atomic.AddInt64(&s.conns, 1)
+		proxy = &proxyConn{Conn: proxy, remoteAddr: &proxyAddr{startPxy.ClientAddr}, sess: s}
 
 		// find tunnel
 		tunnel, ok := s.getTunnel(startPxy.Url)
@@ -268,31 +602,99 @@ func (s *Session) receive() {
 		}
 
 		// deliver proxy connection
-		tunnel.accept <- proxy
+		tunnel.deliver(proxy)
+	}
+
+	// the server opens streams to proxy connections and to send control messages
+	handleStream := func(stream conn.Conn, codec proto.Codec) {
+		if s.isClosing() {
+			stream.Close()
+			return
+		}
+
+		reader := proto.MsgReader{Codec: codec}
+		msg, err := reader.ReadMsg(stream)
+		if err != nil {
+			stream.Error("Failed to read message from server: %v", err)
+			stream.Close()
+			return
+		}
+
+		switch m := msg.(type) {
+		case *proto.StartProxy:
+			handleProxy(stream, m)
+		case *proto.Ping:
+			if err := proto.WriteMsgCodec(stream, codec, &proto.Pong{}); err != nil {
+				stream.Warn("Failed to answer heartbeat: %v", err)
+			}
+			stream.Close()
+		default:
+			stream.Close()
+			s.handleControl(m)
+		}
 	}
 
 	for {
-		// accept the next proxy connection
-		proxy, err := s.raw.Accept()
+		// accept the next stream
+		stream, err := s.raw.Accept()
 		if err != nil {
-			s.raw.Error("Client accept error: %v", err)
+			if s.isClosing() {
+				// closed on purpose
+				err = nil
+			} else {
+				s.raw.Error("Client accept error: %v", err)
+			}
+
+			if !s.managed {
+				s.emit(Event{Type: Disconnected, Err: err})
+			}
+
+			// the connection is gone, so there is no server to unlisten the tunnels with
 			s.RLock()
+			tunnels := make([]*Tunnel, 0, len(s.tunnels))
 			for _, t := range s.tunnels {
-				go t.Close()
+				tunnels = append(tunnels, t)
 			}
 			s.RUnlock()
+			for _, t := range tunnels {
+				t.close(context.Background(), false)
+			}
 			return
 		}
-		go handleProxy(proxy)
+		go handleStream(stream, s.raw.Codec())
+	}
+}
+
+// handleControl handles a message the server sent on its own initiative
+func (s *Session) handleControl(msg proto.Message) {
+	switch m := msg.(type) {
+	case *proto.TunnelClosed:
+		s.raw.Warn("Server closed tunnel %s: %s", m.Url, m.Reason)
+		if t, ok := s.getTunnel(m.Url); ok {
+			t.closedByServer(&TunnelClosedError{Url: m.Url, Reason: m.Reason})
+		}
+		s.emit(Event{Type: TunnelClosed, Url: m.Url, Message: m.Reason})
+
+	case *proto.GoAway:
+		s.raw.Warn("Server is closing the session: %s", m.Reason)
+		atomic.StoreInt64(&s.goAwayDelay, int64(m.ReconnectDelay))
+		s.emit(Event{Type: GoAway, Message: m.Reason, Delay: m.ReconnectDelay, ReconnectAddr: m.ReconnectAddr})
+
+	case *proto.Notice:
+		s.raw.Info("Notice from server: %s", m.Message)
+		s.emit(Event{Type: Notice, Code: m.Code, Message: m.Message, Url: m.Url})
+
+	default:
+		s.raw.Warn("Ignoring unexpected message from server: %T", msg)
 	}
 }
 
-func (s *Session) unlisten(t *Tunnel) error {
+func (s *Session) unlisten(ctx context.Context, t *Tunnel) error {
 	// delete tunnel
 	s.delTunnel(t.url)
 
 	// ask server to unlisten
-	resp, err := s.raw.Unlisten(t.url)
+	resp, err := s.raw.UnlistenContext(ctx, t.url)
 	if err != nil {
 		return err
 	}
@@ -326,12 +728,31 @@ func (s *Session) delTunnel(url string) {
 type proxyConn struct {
 	conn.Conn
 	remoteAddr net.Addr
+	sess       *Session // counts the connection until it's closed
+	closed     int32
+}
+
+func (c *proxyConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.sess.conns, -1)
+	}
+	return c.Conn.Close()
 }
 
 func (c *proxyConn) RemoteAddr() net.Addr {
 	return c.remoteAddr
 }
 
+// CloseWrite half-closes the proxy stream so that conn.JoinHalfClose can forward EOF from the local side
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("Connection does not support half-close")
+}
+
 type proxyAddr struct {
 	addr string
 }
@@ -1,11 +1,13 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	conn "github.com/inconshreveable/go-tunnel/conn"
 	proto "github.com/inconshreveable/go-tunnel/proto"
 	"net"
+	"sync"
 	"sync/atomic"
 )
 
@@ -18,34 +20,181 @@ type Tunnel struct {
 	bindExtra interface{}
 	bindResp  *proto.BindResp
 	accept    chan conn.Conn
+	done      chan struct{} // closed when the tunnel is closed
 	proto     string
 	closed    int32
+	err       error // why the tunnel was closed, set before done is closed
+
+	// connections currently being forwarded and lifetime byte counts, see ForwardTo
+	conns    int64
+	bytesIn  int64
+	bytesOut int64
 }
 
 func (t *Tunnel) Accept() (net.Conn, error) {
 	select {
-	case conn, ok := <-t.accept:
-		if !ok {
-			return nil, errors.New("Tunnel closed")
-		}
+	case conn := <-t.accept:
 		return conn, nil
+	case <-t.done:
+		return nil, t.closeErr()
 	}
 	return nil, errors.New("Unexpected select condition")
 }
 
+// AcceptContext is like Accept, but gives up waiting for a connection once ctx is done
+func (t *Tunnel) AcceptContext(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-t.accept:
+		return conn, nil
+	case <-t.done:
+		return nil, t.closeErr()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops accepting connections on the tunnel and asks the server to unbind it
 func (t *Tunnel) Close() error {
+	return t.close(context.Background(), true)
+}
+
+// close closes the tunnel, and asks the server to unbind it if unlisten is set.
+// The server need not be asked when the session's connection is already gone.
+func (t *Tunnel) close(ctx context.Context, unlisten bool) error {
 	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
 		return fmt.Errorf("Already closed")
 	}
 
-	close(t.accept)
-	return t.sess.unlisten(t)
+	close(t.done)
+	if !unlisten {
+		t.sess.delTunnel(t.url)
+		return nil
+	}
+	return t.sess.unlisten(ctx, t)
+}
+
+// closedByServer closes a tunnel which the server unbound on its own. Accept returns err from then on.
+func (t *Tunnel) closedByServer(err error) {
+	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		return
+	}
+
+	t.err = err
+	close(t.done)
+	t.sess.delTunnel(t.url)
+}
+
+// closeErr returns the error to report once the tunnel is closed
+func (t *Tunnel) closeErr() error {
+	if t.err != nil {
+		return t.err
+	}
+	return errors.New("Tunnel closed")
+}
+
+// deliver hands a proxied connection to whoever accepts from the tunnel,
+// closing it instead if the tunnel is closed first
+func (t *Tunnel) deliver(c conn.Conn) {
+	select {
+	case t.accept <- c:
+	case <-t.done:
+		c.Warn("Tunnel %s closed before connection was accepted", t.url)
+		c.Close()
+	}
+}
+
+// ForwardTo accepts connections on the tunnel and forwards each of them to a
+// new connection to localAddr, dialed with the given network, copying data in
+// both directions until both sides are done. A connection which can't be
+// dialed is closed and logged without interrupting the others.
+//
+// ForwardTo returns when the tunnel is closed or ctx is done, after all of the
+// connections it forwarded have finished. Connections still being forwarded
+// when ctx is done are closed. The tunnel itself is left open in that case.
+func (t *Tunnel) ForwardTo(ctx context.Context, network, localAddr string) error {
+	var wait sync.WaitGroup
+	defer wait.Wait()
+
+	for {
+		select {
+		case remote := <-t.accept:
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				t.forward(ctx, remote, network, localAddr)
+			}()
+
+		case <-t.done:
+			return t.closeErr()
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (t *Tunnel) forward(ctx context.Context, remote conn.Conn, network, localAddr string) {
+	var dialer net.Dialer
+	rawLocal, err := dialer.DialContext(ctx, network, localAddr)
+	if err != nil {
+		remote.Warn("Failed to forward connection from %s to %s: %v", remote.RemoteAddr(), localAddr, err)
+		remote.Close()
+		return
+	}
+
+	local := conn.Wrap(rawLocal, "local", localAddr)
+	remote.Info("Forwarding connection from %s to %s", remote.RemoteAddr(), localAddr)
+
+	// tear the connection down if ctx is done before it finishes
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			local.Close()
+			remote.Close()
+		case <-finished:
+		}
+	}()
+
+	atomic.AddInt64(&t.conns, 1)
+	bytesIn, bytesOut := conn.JoinHalfClose(local, remote)
+	atomic.AddInt64(&t.conns, -1)
+	atomic.AddInt64(&t.bytesIn, bytesIn)
+	atomic.AddInt64(&t.bytesOut, bytesOut)
+}
+
+// Connections returns the number of connections ForwardTo is currently forwarding
+func (t *Tunnel) Connections() int64 {
+	return atomic.LoadInt64(&t.conns)
+}
+
+// BytesIn returns the number of bytes ForwardTo has received over the tunnel
+// and written to local connections
+func (t *Tunnel) BytesIn() int64 {
+	return atomic.LoadInt64(&t.bytesIn)
+}
+
+// BytesOut returns the number of bytes ForwardTo has read from local connections
+// and sent back over the tunnel
+func (t *Tunnel) BytesOut() int64 {
+	return atomic.LoadInt64(&t.bytesOut)
 }
 
 func (t *Tunnel) Addr() net.Addr {
 	return &Addr{net: t.proto, addr: t.url}
 }
 
+// A TunnelClosedError is returned by Accept once the server closed the tunnel on its own
+type TunnelClosedError struct {
+	Url    string // the url of the tunnel
+	Reason string // why the server closed it
+}
+
+func (e *TunnelClosedError) Error() string {
+	return fmt.Sprintf("Tunnel %s closed by the server: %s", e.Url, e.Reason)
+}
+
 type Addr struct {
 	net  string
 	addr string
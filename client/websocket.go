@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	muxado "github.com/inconshreveable/muxado"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketDialer returns a dialer for NewReconnectingSession which runs the session over a
+// WebSocket connection to url, a ws:// or wss:// URL served by the server's WebSocketHandler.
+// tlsConfig configures wss:// connections and may be nil.
+func WebSocketDialer(url string, tlsConfig *tls.Config) func() (muxado.Session, error) {
+	return func() (muxado.Session, error) {
+		return DialWebSocketContext(context.Background(), url, tlsConfig)
+	}
+}
+
+// DialWebSocketContext opens a WebSocket connection to url for a tunnel session, giving up once ctx is done
+func DialWebSocketContext(ctx context.Context, url string, tlsConfig *tls.Config) (muxado.Session, error) {
+	config, err := websocket.NewConfig(url, url)
+	if err != nil {
+		return nil, err
+	}
+
+	var addr string
+	switch config.Location.Scheme {
+	case "ws":
+		addr = hostPort(config.Location.Host, "80")
+	case "wss":
+		addr = hostPort(config.Location.Host, "443")
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+	default:
+		return nil, fmt.Errorf("WebSocket URL scheme must be ws or wss, got: %s", config.Location.Scheme)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Location.Scheme == "wss" {
+		if conn, err = clientTLS(ctx, conn, addr, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	// give up on the handshake once ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed WebSocket handshake with %s: %v", config.Location.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	ws.PayloadType = websocket.BinaryFrame
+	return muxado.Client(ws), nil
+}
+
+// hostPort adds the default port to host if it has none
+func hostPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
@@ -2,6 +2,7 @@ package conn
 
 import (
 	"crypto/tls"
+	"errors"
 	log "github.com/inconshreveable/go-tunnel/log"
 	util "github.com/inconshreveable/go-tunnel/util"
 	"io"
@@ -99,6 +100,20 @@ func (c *Logged) Id() string {
 	return c.Logger.Name()
 }
 
+// closeWriter is implemented by connections which can be half-closed
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of the connection, if the underlying
+// connection supports it, so that the other end reads EOF but may keep sending.
+func (c *Logged) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("Connection does not support half-close")
+}
+
 func Join(c Conn, c2 Conn) (int64, int64) {
 	var wait sync.WaitGroup
 
@@ -124,3 +139,44 @@ func Join(c Conn, c2 Conn) (int64, int64) {
 	wait.Wait()
 	return fromBytes, toBytes
 }
+
+// JoinHalfClose copies data between c and c2 like Join, but when one side reaches
+// EOF, the other side is half-closed so that it can finish sending its response.
+// If it can't be half-closed, both connections are closed right away. It returns
+// the number of bytes copied to c and to c2, respectively, once both are closed.
+//
+// A side which never stops sending after being half-closed keeps the join open,
+// so only use it where the other side is trusted to finish, e.g. a local service.
+func JoinHalfClose(c Conn, c2 Conn) (int64, int64) {
+	var wait sync.WaitGroup
+
+	pipe := func(to Conn, from Conn, bytesCopied *int64) {
+		defer wait.Done()
+
+		var err error
+		*bytesCopied, err = io.Copy(to, from)
+		if err != nil {
+			from.Warn("Copied %d bytes to %s before failing with error %v", *bytesCopied, to.Name(), err)
+		} else {
+			from.Debug("Copied %d bytes to %s", *bytesCopied, to.Name())
+
+			// let the other direction finish
+			if cw, ok := to.(closeWriter); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+
+		to.Close()
+		from.Close()
+	}
+
+	wait.Add(2)
+	var fromBytes, toBytes int64
+	go pipe(c, c2, &fromBytes)
+	go pipe(c2, c, &toBytes)
+	c.Info("Joined with connection %s", c2.Name())
+	wait.Wait()
+	c.Close()
+	c2.Close()
+	return fromBytes, toBytes
+}
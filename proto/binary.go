@@ -0,0 +1,297 @@
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// binaryTypes assigns each message type the number which identifies it in the binary
+// encoding. A number must never be reused, so new types may only be appended.
+var binaryTypes = []string{
+	"Auth",
+	"AuthResp",
+	"Bind",
+	"BindResp",
+	"Unbind",
+	"UnbindResp",
+	"StartProxy",
+	"TunnelClosed",
+	"GoAway",
+	"Notice",
+	"Ping",
+	"Pong",
+}
+
+var binaryTypeIds map[string]uint64
+
+func init() {
+	binaryTypeIds = make(map[string]uint64)
+	for id, name := range binaryTypes {
+		binaryTypeIds[name] = uint64(id)
+	}
+}
+
+var errMalformed = errors.New("Malformed binary message")
+
+// binaryCodec encodes a message as the uvarint number of its type followed by its
+// fields. Each field which doesn't have its zero value is encoded as its name and
+// its value, both prefixed with their length as a uvarint, so that a peer can skip
+// fields it doesn't know. Values are encoded by kind:
+//
+//	string           the bytes of the string
+//	bool             a single byte, 1 for true
+//	ints             a varint, e.g. a time.Duration in nanoseconds
+//	uints            a uvarint
+//	[]byte           the bytes
+//	slices           each element, prefixed with its length
+//	maps             each key and value, prefixed with their lengths
+//	interface{}      the JSON encoding of the value
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Encode(msg Message) ([]byte, error) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Cannot encode %T as a message", msg)
+	}
+	v = v.Elem()
+
+	id, ok := binaryTypeIds[v.Type().Name()]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported message type %s", v.Type().Name())
+	}
+
+	buffer := appendUvarint(nil, id)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := v.Field(i)
+		if t.Field(i).PkgPath != "" || f.IsZero() {
+			continue
+		}
+
+		value, err := encodeValue(nil, f)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode %s.%s: %v", t.Name(), t.Field(i).Name, err)
+		}
+		buffer = appendBytes(buffer, []byte(t.Field(i).Name))
+		buffer = appendBytes(buffer, value)
+	}
+	return buffer, nil
+}
+
+func (c binaryCodec) Decode(buffer []byte) (Message, error) {
+	id, n := binary.Uvarint(buffer)
+	if n <= 0 {
+		return nil, errMalformed
+	}
+	if id >= uint64(len(binaryTypes)) {
+		return nil, fmt.Errorf("Unsupported message type %d", id)
+	}
+
+	msg := reflect.New(TypeMap[binaryTypes[id]])
+	if err := decodeFields(msg.Elem(), buffer[n:]); err != nil {
+		return nil, err
+	}
+	return msg.Interface(), nil
+}
+
+func (c binaryCodec) DecodeInto(buffer []byte, msg Message) error {
+	v, err := messageStruct(msg)
+	if err != nil {
+		return err
+	}
+
+	id, n := binary.Uvarint(buffer)
+	if n <= 0 {
+		return errMalformed
+	}
+	if expected, ok := binaryTypeIds[v.Type().Name()]; !ok || id != expected {
+		return fmt.Errorf("Expected a %s message, got message type %d", v.Type().Name(), id)
+	}
+	return decodeFields(v, buffer[n:])
+}
+
+func decodeFields(v reflect.Value, buffer []byte) (err error) {
+	var name, value []byte
+	for len(buffer) > 0 {
+		if name, buffer, err = readBytes(buffer); err != nil {
+			return
+		}
+		if value, buffer, err = readBytes(buffer); err != nil {
+			return
+		}
+
+		// skip fields added by newer peers
+		field, ok := v.Type().FieldByName(string(name))
+		if !ok || field.PkgPath != "" || len(field.Index) != 1 {
+			continue
+		}
+
+		if err = decodeValue(v.Field(field.Index[0]), value); err != nil {
+			return fmt.Errorf("Failed to decode %s.%s: %v", v.Type().Name(), name, err)
+		}
+	}
+	return
+}
+
+func encodeValue(buffer []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.String:
+		return append(buffer, v.String()...), nil
+
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buffer, 1), nil
+		}
+		return append(buffer, 0), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var scratch [binary.MaxVarintLen64]byte
+		return append(buffer, scratch[:binary.PutVarint(scratch[:], v.Int())]...), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendUvarint(buffer, v.Uint()), nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(buffer, v.Bytes()...), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			elem, err := encodeValue(nil, v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			buffer = appendBytes(buffer, elem)
+		}
+		return buffer, nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("Unsupported map key type %s", v.Type().Key())
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			elem, err := encodeValue(nil, iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			buffer = appendBytes(buffer, []byte(iter.Key().String()))
+			buffer = appendBytes(buffer, elem)
+		}
+		return buffer, nil
+
+	case reflect.Interface:
+		raw, err := marshalRaw(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return append(buffer, raw...), nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported type %s", v.Type())
+	}
+}
+
+func decodeValue(v reflect.Value, buffer []byte) (err error) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(buffer))
+
+	case reflect.Bool:
+		if len(buffer) != 1 {
+			return errMalformed
+		}
+		v.SetBool(buffer[0] != 0)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, n := binary.Varint(buffer)
+		if n != len(buffer) || v.OverflowInt(i) {
+			return errMalformed
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, n := binary.Uvarint(buffer)
+		if n != len(buffer) || v.OverflowUint(u) {
+			return errMalformed
+		}
+		v.SetUint(u)
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), buffer...))
+			return
+		}
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		var elem []byte
+		for len(buffer) > 0 {
+			if elem, buffer, err = readBytes(buffer); err != nil {
+				return
+			}
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err = decodeValue(e, elem); err != nil {
+				return
+			}
+			slice = reflect.Append(slice, e)
+		}
+		v.Set(slice)
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("Unsupported map key type %s", v.Type().Key())
+		}
+		m := reflect.MakeMap(v.Type())
+		var key, elem []byte
+		for len(buffer) > 0 {
+			if key, buffer, err = readBytes(buffer); err != nil {
+				return
+			}
+			if elem, buffer, err = readBytes(buffer); err != nil {
+				return
+			}
+			k := reflect.New(v.Type().Key()).Elem()
+			k.SetString(string(key))
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err = decodeValue(e, elem); err != nil {
+				return
+			}
+			m.SetMapIndex(k, e)
+		}
+		v.Set(m)
+
+	case reflect.Interface:
+		if v.Type().NumMethod() != 0 {
+			return fmt.Errorf("Unsupported type %s", v.Type())
+		}
+		if !json.Valid(buffer) {
+			return errMalformed
+		}
+		v.Set(reflect.ValueOf(RawValue(append([]byte(nil), buffer...))))
+
+	default:
+		return fmt.Errorf("Unsupported type %s", v.Type())
+	}
+	return
+}
+
+func appendUvarint(buffer []byte, x uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buffer, scratch[:binary.PutUvarint(scratch[:], x)]...)
+}
+
+func appendBytes(buffer, b []byte) []byte {
+	return append(appendUvarint(buffer, uint64(len(b))), b...)
+}
+
+// readBytes reads a length-prefixed byte string off the front of buffer
+func readBytes(buffer []byte) (b []byte, rest []byte, err error) {
+	l, n := binary.Uvarint(buffer)
+	if n <= 0 || l > uint64(len(buffer)-n) {
+		return nil, nil, errMalformed
+	}
+	return buffer[n : n+int(l)], buffer[n+int(l):], nil
+}
@@ -0,0 +1,252 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMessages holds a message of every type with each of its fields set
+var testMessages = []Message{
+	&Auth{
+		Version:      []string{"2", "1"},
+		ClientId:     "client-id",
+		ResumeToken:  "token",
+		Capabilities: Capabilities{CapHeartbeat: "1", CapBinaryCodec: "1"},
+		Extra:        map[string]interface{}{"User": "alice", "Count": 3.0},
+	},
+	&AuthResp{
+		Version:      "2",
+		ClientId:     "client-id",
+		ResumeToken:  "token",
+		Capabilities: Capabilities{CapServerPush: "1"},
+		Error:        "error",
+		Extra:        "extra",
+	},
+	&Bind{
+		Protocol:  "http",
+		Options:   &HTTPOptions{Hostname: "example.com", Subdomain: "sub", Auth: "user:pass"},
+		Extra:     []interface{}{"a", 1.0},
+		ResumeUrl: "http://sub.example.com",
+	},
+	&BindResp{Url: "tcp://example.com:1234", Protocol: "tcp", Error: "error", Extra: true},
+	&Unbind{Url: "http://sub.example.com", Extra: map[string]interface{}{"Why": "done"}},
+	&UnbindResp{Error: "error", Extra: 42.0},
+	&StartProxy{Url: "http://sub.example.com", ClientAddr: "10.0.0.1:5000"},
+	&TunnelClosed{Url: "http://sub.example.com", Reason: "unbound by operator"},
+	&GoAway{Reason: "restart", ReconnectDelay: 1500 * time.Millisecond, ReconnectAddr: "other.example.com:4443"},
+	&Notice{Code: "quota", Message: "almost there", Url: "http://sub.example.com"},
+	&Ping{},
+	&Pong{},
+}
+
+// sameMessage compares messages by their JSON encoding, because interface{} fields
+// are decoded as RawValues
+func sameMessage(t *testing.T, want, got Message) {
+	t.Helper()
+	if reflect.TypeOf(want) != reflect.TypeOf(got) {
+		t.Fatalf("decoded a %T, want a %T", got, want)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wantJSON, gotJSON) {
+		t.Errorf("decoded %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func TestTestMessagesCoverEveryType(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, msg := range testMessages {
+		covered[reflect.TypeOf(msg).Elem().Name()] = true
+	}
+	for name := range TypeMap {
+		if !covered[name] {
+			t.Errorf("no test message of type %s", name)
+		}
+	}
+	for _, name := range binaryTypes {
+		if _, ok := TypeMap[name]; !ok {
+			t.Errorf("binary type %s is missing from TypeMap", name)
+		}
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSON, Binary} {
+		for _, msg := range testMessages {
+			name := codec.Name() + "/" + reflect.TypeOf(msg).Elem().Name()
+			t.Run(name, func(t *testing.T) {
+				buffer, err := codec.Encode(msg)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+
+				decoded, err := codec.Decode(buffer)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				sameMessage(t, msg, decoded)
+
+				into := reflect.New(reflect.TypeOf(msg).Elem()).Interface()
+				if err := codec.DecodeInto(buffer, into); err != nil {
+					t.Fatalf("DecodeInto: %v", err)
+				}
+				sameMessage(t, msg, into)
+			})
+		}
+	}
+}
+
+func TestBinaryZeroValues(t *testing.T) {
+	buffer, err := Binary.Encode(&Notice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buffer) != 1 {
+		t.Errorf("encoded an empty Notice in %d bytes, want only its type", len(buffer))
+	}
+
+	msg, err := Binary.Decode(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(msg, &Notice{}) {
+		t.Errorf("decoded %+v, want an empty Notice", msg)
+	}
+}
+
+func TestBinaryInterfaceFieldsAreRaw(t *testing.T) {
+	buffer, err := Binary.Encode(testMessages[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := Binary.Decode(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bind := msg.(*Bind)
+	if _, ok := bind.Options.(RawValue); !ok {
+		t.Fatalf("decoded Options as a %T, want a RawValue", bind.Options)
+	}
+	if err := DecodeBind(bind); err != nil {
+		t.Fatal(err)
+	}
+	want := &HTTPOptions{Hostname: "example.com", Subdomain: "sub", Auth: "user:pass"}
+	if !reflect.DeepEqual(bind.Options, want) {
+		t.Errorf("decoded Options %+v, want %+v", bind.Options, want)
+	}
+}
+
+func TestBinarySkipsUnknownFields(t *testing.T) {
+	buffer := appendUvarint(nil, binaryTypeIds["Notice"])
+	buffer = appendBytes(buffer, []byte("Code"))
+	buffer = appendBytes(buffer, []byte("quota"))
+	buffer = appendBytes(buffer, []byte("AddedLater"))
+	buffer = appendBytes(buffer, []byte{1, 2, 3})
+	buffer = appendBytes(buffer, []byte("url"))
+	buffer = appendBytes(buffer, []byte("unexported names don't match"))
+
+	msg, err := Binary.Decode(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Notice{Code: "quota"}); !reflect.DeepEqual(msg, want) {
+		t.Errorf("decoded %+v, want %+v", msg, want)
+	}
+}
+
+func TestBinaryRejects(t *testing.T) {
+	valid, err := Binary.Encode(&StartProxy{Url: "http://example.com", ClientAddr: "10.0.0.1:5000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := func(typ, name string, value []byte) []byte {
+		buffer := appendUvarint(nil, binaryTypeIds[typ])
+		return appendBytes(appendBytes(buffer, []byte(name)), value)
+	}
+
+	tests := []struct {
+		name   string
+		buffer []byte
+		into   Message
+		err    string
+	}{
+		{"empty", nil, nil, "Malformed"},
+		{"unknown type", appendUvarint(nil, uint64(len(binaryTypes))), nil, "Unsupported message type"},
+		{"truncated name", valid[:2], nil, "Malformed"},
+		{"truncated value", valid[:len(valid)-1], nil, "Malformed"},
+		{"bad int", field("GoAway", "ReconnectDelay", []byte{0x80}), nil, "Malformed"},
+		{"bad json", field("Bind", "Options", []byte("{")), nil, "Malformed"},
+		{"wrong type", valid, new(Auth), "Expected a Auth message"},
+		{"wrong type into empty", appendUvarint(nil, binaryTypeIds["Pong"]), new(Ping), "Expected a Ping message"},
+		{"not a message", valid, new(string), "Cannot decode"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.into == nil {
+				_, err = Binary.Decode(tt.buffer)
+			} else {
+				err = Binary.DecodeInto(tt.buffer, tt.into)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBinaryEncodeRejects(t *testing.T) {
+	type Unregistered struct{ Url string }
+
+	for _, msg := range []Message{nil, Auth{}, (*Auth)(nil), &Unregistered{Url: "x"}} {
+		if _, err := Binary.Encode(msg); err == nil {
+			t.Errorf("encoded %#v, want an error", msg)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	msg := &StartProxy{Url: "http://sub.example.com", ClientAddr: "10.0.0.1:5000"}
+	for _, codec := range []Codec{JSON, Binary} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Encode(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	msg := &StartProxy{Url: "http://sub.example.com", ClientAddr: "10.0.0.1:5000"}
+	for _, codec := range []Codec{JSON, Binary} {
+		buffer, err := codec.Encode(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buffer)))
+			for i := 0; i < b.N; i++ {
+				var sp StartProxy
+				if err := codec.DecodeInto(buffer, &sp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package proto
+
+// Names of the optional protocol features a peer may advertise in the
+// Capabilities of its Auth or AuthResp message
+const (
+	// the peer answers Ping messages with a Pong
+	CapHeartbeat = "heartbeat"
+
+	// the client understands TunnelClosed, GoAway and Notice messages sent by the server
+	CapServerPush = "server-push"
+
+	// the peer encodes the messages following AuthResp with the Binary codec
+	CapBinaryCodec = "binary-codec"
+)
+
+// Capabilities maps the names of the optional protocol features a peer supports
+// to feature-specific parameters, which are empty for most features. A client
+// advertises its capabilities in its Auth message and the server responds with
+// the ones both of them support, so that new features are only used with peers
+// which understand them. Peers which predate capabilities advertise none.
+type Capabilities map[string]string
+
+// Supported are the capabilities of this implementation
+var Supported = Capabilities{
+	CapHeartbeat:   "",
+	CapServerPush:  "",
+	CapBinaryCodec: "",
+}
+
+// Has reports whether the capability is present
+func (c Capabilities) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// Intersect returns the capabilities present in both c and other,
+// with the parameters of c
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	both := make(Capabilities)
+	for name, param := range c {
+		if other.Has(name) {
+			both[name] = param
+		}
+	}
+	return both
+}
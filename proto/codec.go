@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// A Codec encodes messages for the wire and decodes them again. Auth and
+// AuthResp messages are always JSON encoded, all messages after them use
+// the codec the client and the server negotiated, see NegotiatedCodec.
+type Codec interface {
+	// Name identifies the codec in log messages
+	Name() string
+
+	// Encode encodes msg, which must be a pointer to one of the types in TypeMap
+	Encode(msg Message) ([]byte, error)
+
+	// Decode decodes a message, deducing its type from the encoding
+	Decode(buffer []byte) (Message, error)
+
+	// DecodeInto decodes a message into msg
+	DecodeInto(buffer []byte, msg Message) error
+}
+
+var (
+	// JSON encodes messages as JSON envelopes naming the type of their payload.
+	// Every peer understands it.
+	JSON Codec = jsonCodec{}
+
+	// Binary is a compact binary encoding which is cheaper to produce and parse
+	// than JSON. It is only used with peers which have the CapBinaryCodec capability.
+	Binary Codec = binaryCodec{}
+)
+
+// NegotiatedCodec returns the codec to use for the messages of a session
+// with the given negotiated capabilities
+func NegotiatedCodec(caps Capabilities) Codec {
+	if caps.Has(CapBinaryCodec) {
+		return Binary
+	}
+	return JSON
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                                { return "json" }
+func (jsonCodec) Encode(msg Message) ([]byte, error)          { return Pack(msg) }
+func (jsonCodec) Decode(buffer []byte) (Message, error)       { return Unpack(buffer) }
+func (jsonCodec) DecodeInto(buffer []byte, msg Message) error { return UnpackInto(buffer, msg) }
+
+// A RawValue holds the encoding of an interface{} field of a decoded message, like
+// Bind.Options or Auth.Extra, which only the receiver knows the type of. Decode it
+// into that type with UnpackInterfaceField.
+type RawValue []byte
+
+// MarshalJSON returns the value as it was received
+func (v RawValue) MarshalJSON() ([]byte, error) {
+	if len(v) == 0 {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+// UnmarshalJSON keeps a copy of data
+func (v *RawValue) UnmarshalJSON(data []byte) error {
+	*v = append((*v)[0:0], data...)
+	return nil
+}
+
+func (v RawValue) String() string {
+	return string(v)
+}
+
+// rawFields makes the empty interface{} fields of the message struct v hold a *RawValue,
+// so that JSON decoding keeps the encoding of their values instead of guessing their type
+func rawFields(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); isRawField(f) && f.IsNil() {
+			f.Set(reflect.ValueOf(new(RawValue)))
+		}
+	}
+}
+
+// settleRawFields replaces the *RawValue in the interface{} fields of the message struct v
+// with the RawValue itself, or nil if the field was null or missing
+func settleRawFields(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !isRawField(f) || f.IsNil() {
+			continue
+		}
+		if raw, ok := f.Interface().(*RawValue); ok {
+			if len(*raw) == 0 || string(*raw) == "null" {
+				f.Set(reflect.Zero(f.Type()))
+			} else {
+				f.Set(reflect.ValueOf(*raw))
+			}
+		}
+	}
+}
+
+func isRawField(f reflect.Value) bool {
+	return f.Kind() == reflect.Interface && f.Type().NumMethod() == 0 && f.CanSet()
+}
+
+// messageStruct returns the struct msg points to. If msg points to a nil pointer,
+// like the address of a *Auth which is still nil, the struct is allocated.
+func messageStruct(msg Message) (reflect.Value, error) {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return reflect.Value{}, fmt.Errorf("Cannot decode a message into %T", msg)
+	}
+
+	for v = v.Elem(); v.Kind() == reflect.Ptr; v = v.Elem() {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+	}
+
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("Cannot decode a message into %T", msg)
+	}
+	return v, nil
+}
+
+// marshalRaw returns the JSON encoding of the value of an interface{} field
+func marshalRaw(value interface{}) ([]byte, error) {
+	if raw, ok := value.(RawValue); ok {
+		return raw, nil
+	}
+	return json.Marshal(value)
+}
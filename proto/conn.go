@@ -2,11 +2,85 @@ package proto
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"github.com/inconshreveable/go-tunnel/conn"
 	"io"
+	"net"
+	"reflect"
+	"time"
 )
 
-func readMsgShared(c conn.Conn) (buffer []byte, err error) {
+// DefaultMaxMsgSize is the largest message ReadMsg and ReadMsgInto will accept
+const DefaultMaxMsgSize = 1 << 20
+
+// A MsgSizeError is returned when a peer announces a message that is
+// larger than the reader allows or has a nonsensical length
+type MsgSizeError struct {
+	Size int64 // announced size of the message
+	Max  int64 // largest size the reader accepts
+}
+
+func (e *MsgSizeError) Error() string {
+	return fmt.Sprintf("Message size %d is outside of the allowed range [0, %d]", e.Size, e.Max)
+}
+
+// A MsgTimeoutError is returned when a peer fails to send a whole
+// message before the reader's deadline
+type MsgTimeoutError struct {
+	Timeout time.Duration // time allowed to read the message
+	Err     error         // underlying error from the connection
+}
+
+func (e *MsgTimeoutError) Error() string {
+	return fmt.Sprintf("Failed to read message within %v: %v", e.Timeout, e.Err)
+}
+
+// A MsgReader reads messages while enforcing limits on how large they may be
+// and how long the peer may take to send each one.
+type MsgReader struct {
+	// MaxSize is the largest message accepted. Zero means DefaultMaxMsgSize.
+	MaxSize int64
+
+	// Timeout is how long the peer has to send each message. Zero means no deadline.
+	Timeout time.Duration
+
+	// Codec decodes the messages. Nil means JSON.
+	Codec Codec
+}
+
+// DefaultReader is used by ReadMsg and ReadMsgInto. It limits
+// messages to DefaultMaxMsgSize and does not set deadlines.
+var DefaultReader = &MsgReader{MaxSize: DefaultMaxMsgSize}
+
+func (r *MsgReader) maxSize() int64 {
+	if r.MaxSize == 0 {
+		return DefaultMaxMsgSize
+	}
+	return r.MaxSize
+}
+
+func (r *MsgReader) codec() Codec {
+	if r.Codec == nil {
+		return JSON
+	}
+	return r.Codec
+}
+
+func (r *MsgReader) readMsgShared(c conn.Conn) (buffer []byte, err error) {
+	if r.Timeout > 0 {
+		if err = c.SetReadDeadline(time.Now().Add(r.Timeout)); err != nil {
+			return
+		}
+		defer c.SetReadDeadline(time.Time{})
+
+		defer func() {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				err = &MsgTimeoutError{Timeout: r.Timeout, Err: err}
+			}
+		}()
+	}
+
 	c.Debug("Waiting to read message")
 	var sz int64
 	err = binary.Read(c, binary.LittleEndian, &sz)
@@ -14,40 +88,69 @@ func readMsgShared(c conn.Conn) (buffer []byte, err error) {
 		return
 	}
 
+	if sz < 0 || sz > r.maxSize() {
+		err = &MsgSizeError{Size: sz, Max: r.maxSize()}
+		return
+	}
+
 	c.Debug("Reading message with length: %d", sz)
 	buffer = make([]byte, sz)
 	if _, err = io.ReadFull(c, buffer); err != nil {
 		return
 	}
-
-	c.Debug("Read message %s", buffer)
 	return
 }
 
-func ReadMsg(c conn.Conn) (msg Message, err error) {
-	buffer, err := readMsgShared(c)
+// ReadMsg reads the next message from c, deducing its type from the envelope
+func (r *MsgReader) ReadMsg(c conn.Conn) (msg Message, err error) {
+	buffer, err := r.readMsgShared(c)
 	if err != nil {
 		return
 	}
 
-	return Unpack(buffer)
+	if msg, err = r.codec().Decode(buffer); err != nil {
+		return
+	}
+
+	c.Debug("Read %s message %s", r.codec().Name(), loggable{msg})
+	return
 }
 
-func ReadMsgInto(c conn.Conn, msg Message) (err error) {
-	buffer, err := readMsgShared(c)
+// ReadMsgInto reads the next message from c into msg
+func (r *MsgReader) ReadMsgInto(c conn.Conn, msg Message) (err error) {
+	buffer, err := r.readMsgShared(c)
 	if err != nil {
 		return
 	}
-	return UnpackInto(buffer, msg)
+	if err = r.codec().DecodeInto(buffer, msg); err != nil {
+		return
+	}
+
+	c.Debug("Read %s message %s", r.codec().Name(), loggable{msg})
+	return
 }
 
+func ReadMsg(c conn.Conn) (msg Message, err error) {
+	return DefaultReader.ReadMsg(c)
+}
+
+func ReadMsgInto(c conn.Conn, msg Message) (err error) {
+	return DefaultReader.ReadMsgInto(c, msg)
+}
+
+// WriteMsg writes msg to c as JSON
 func WriteMsg(c conn.Conn, msg interface{}) (err error) {
-	buffer, err := Pack(msg)
+	return WriteMsgCodec(c, JSON, msg)
+}
+
+// WriteMsgCodec writes msg to c encoded with codec
+func WriteMsgCodec(c conn.Conn, codec Codec, msg interface{}) (err error) {
+	buffer, err := codec.Encode(msg)
 	if err != nil {
 		return
 	}
 
-	c.Debug("Writing message: %s", string(buffer))
+	c.Debug("Writing %s message: %s", codec.Name(), loggable{msg})
 	if err = binary.Write(c, binary.LittleEndian, int64(len(buffer))); err != nil {
 		return
 	}
@@ -58,3 +161,61 @@ func WriteMsg(c conn.Conn, msg interface{}) (err error) {
 
 	return
 }
+
+// loggable renders a message for debug logs, but only once it is actually logged
+// because that takes as long as encoding the message. The secrets of Auth and
+// AuthResp messages and the credentials in the options of Bind messages are left out.
+type loggable struct {
+	msg interface{}
+}
+
+func (l loggable) String() string {
+	v := reflect.ValueOf(l.msg)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Ptr {
+		return fmt.Sprintf("%v", l.msg)
+	}
+
+	var msg interface{} = l.msg
+	switch m := v.Interface().(type) {
+	case Auth:
+		if m.ResumeToken != "" {
+			m.ResumeToken = redacted
+		}
+		if m.Extra != nil {
+			m.Extra = redacted
+		}
+		msg = m
+	case AuthResp:
+		if m.ResumeToken != "" {
+			m.ResumeToken = redacted
+		}
+		msg = m
+	case Bind:
+		m.Options = redactedOptions(m.Options)
+		msg = m
+	}
+
+	buffer, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("%+v", msg)
+	}
+	return string(buffer)
+}
+
+const redacted = "REDACTED"
+
+// redactedOptions returns bind options with the Auth of HTTPOptions replaced,
+// whichever type the options were decoded into
+func redactedOptions(options interface{}) interface{} {
+	var opts map[string]interface{}
+	if err := UnpackInterfaceField(options, &opts); err != nil || opts == nil {
+		return options
+	}
+	if auth, ok := opts["Auth"]; ok && auth != nil && auth != "" {
+		opts["Auth"] = redacted
+	}
+	return opts
+}
@@ -3,6 +3,7 @@ package proto
 import (
 	"encoding/json"
 	"reflect"
+	"time"
 )
 
 var TypeMap map[string]reflect.Type
@@ -15,7 +16,14 @@ func init() {
 	TypeMap["AuthResp"] = t((*AuthResp)(nil))
 	TypeMap["Bind"] = t((*Bind)(nil))
 	TypeMap["BindResp"] = t((*BindResp)(nil))
+	TypeMap["Unbind"] = t((*Unbind)(nil))
+	TypeMap["UnbindResp"] = t((*UnbindResp)(nil))
 	TypeMap["StartProxy"] = t((*StartProxy)(nil))
+	TypeMap["TunnelClosed"] = t((*TunnelClosed)(nil))
+	TypeMap["GoAway"] = t((*GoAway)(nil))
+	TypeMap["Notice"] = t((*Notice)(nil))
+	TypeMap["Ping"] = t((*Ping)(nil))
+	TypeMap["Pong"] = t((*Pong)(nil))
 }
 
 type Message interface{}
@@ -28,9 +36,11 @@ type Envelope struct {
 // When a client opens a new control channel to the server
 // it must start by sending an Auth message.
 type Auth struct {
-	Version  []string    // protocol versions supported, ordered by preference
-	ClientId string      // empty for new sessions
-	Extra    interface{} // clients may add whatever data the like to auth messages
+	Version      []string     // protocol versions supported, ordered by preference
+	ClientId     string       // empty for new sessions
+	ResumeToken  string       // secret issued in the AuthResp of the session being resumed
+	Capabilities Capabilities // optional protocol features the client supports
+	Extra        interface{}  // clients may add whatever data the like to auth messages
 }
 
 // A server responds to an Auth message with an
@@ -43,19 +53,30 @@ type Auth struct {
 // The server response includes a unique ClientId
 // that is used to associate and authenticate future
 // proxy connections via the same field in RegProxy messages.
+//
+// The ResumeToken is a secret which the client must present
+// along with the ClientId to resume the session after reconnecting.
+// Unlike the ClientId it must never be logged or shared.
+//
+// Capabilities are the optional protocol features supported
+// by both the client and the server, which either of them
+// may use for the rest of the session.
 type AuthResp struct {
-	Version  string // protocol version chosen
-	ClientId string
-	Error    string
-	Extra    interface{}
+	Version      string // protocol version chosen
+	ClientId     string
+	ResumeToken  string
+	Capabilities Capabilities
+	Error        string
+	Extra        interface{}
 }
 
 // A client sends this message to the server over a new stream
 // to request the server bind a remote port/hostname on the client's behalf.
 type Bind struct {
-	Protocol string      // the protocol to bind
-	Options  interface{} // options for the bind - protocol dependent
-	Extra    interface{} // anything extra the application wants to send
+	Protocol  string      // the protocol to bind
+	Options   interface{} // options for the bind - protocol dependent
+	Extra     interface{} // anything extra the application wants to send
+	ResumeUrl string      // url of the tunnel bound by a previous instance of the session, when reconnecting
 }
 
 type HTTPOptions struct {
@@ -102,3 +123,34 @@ type StartProxy struct {
 	Url        string // URL of the tunnel this connection connection is being proxied for
 	ClientAddr string // Network address of the client initiating the connection to the tunnel
 }
+
+// The server sends this message over a new stream to tell the client that it
+// closed one of the client's tunnels on its own, e.g. because an operator unbound it.
+// The client must not try to bind the tunnel again after reconnecting.
+type TunnelClosed struct {
+	Url    string // URL of the tunnel which was closed
+	Reason string // why the server closed the tunnel
+}
+
+// The server sends this message over a new stream shortly before it closes the
+// session, e.g. because it is shutting down to restart.
+type GoAway struct {
+	Reason         string        // why the server is closing the session
+	ReconnectDelay time.Duration // how long the client should wait before reconnecting
+	ReconnectAddr  string        // address of another server to reconnect to, empty for the same one
+}
+
+// The server sends this message over a new stream to warn the client about something
+// which doesn't end the session yet, e.g. that it is about to exceed a quota.
+type Notice struct {
+	Code    string // machine-readable kind of notice, e.g. "quota"
+	Message string // human-readable description
+	Url     string // URL of the tunnel the notice is about, empty for the whole session
+}
+
+// Either side may send this message over a new stream to check that the
+// connection is still alive. The other side answers with a Pong on the same stream.
+type Ping struct{}
+
+// The answer to a Ping
+type Pong struct{}
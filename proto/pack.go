@@ -10,13 +10,29 @@ import (
 // UnpackInterfaceField allows the caller to unpack anything that is specified
 // in the protocol as an interface{}
 // This includes the all Extra fields and the Options for a Bind.
-// This is one of the most awful hacks in the whole library.
-// The trouble is that anything that is passed as an empty interface in
-// the protocol will be deserialized into a map[string]interface{}.
-// So in order to get them in the form we want, we write them out
-// as JSON again and then read them back in with the now-known
-// proper type for deserializion
+// Decoded messages hold such fields as a RawValue, which is decoded
+// straight into deserializeInto. A value which already has the type
+// deserializeInto points to, or is a pointer to one, like the values
+// decoded with DecodeOptions and DecodeExtra, is simply copied. Any
+// other value is written out as JSON and read back in with the
+// now-known proper type for deserializion.
 func UnpackInterfaceField(interfaceField, deserializeInto interface{}) error {
+	if raw, ok := interfaceField.(RawValue); ok {
+		return json.Unmarshal(raw, deserializeInto)
+	}
+
+	src, dst := reflect.ValueOf(interfaceField), reflect.ValueOf(deserializeInto)
+	if src.IsValid() && dst.Kind() == reflect.Ptr && !dst.IsNil() {
+		switch {
+		case src.Type() == dst.Type() && !src.IsNil():
+			dst.Elem().Set(src.Elem())
+			return nil
+		case src.Type() == dst.Elem().Type():
+			dst.Elem().Set(src)
+			return nil
+		}
+	}
+
 	bytes, err := json.Marshal(interfaceField)
 	if err != nil {
 		return err
@@ -49,7 +65,16 @@ func unpack(buffer []byte, msgIn Message) (msg Message, err error) {
 		msg = msgIn
 	}
 
-	err = json.Unmarshal(env.Payload, &msg)
+	v, err := messageStruct(msg)
+	if err != nil {
+		return
+	}
+
+	rawFields(v)
+	if err = json.Unmarshal(env.Payload, msg); err != nil {
+		return
+	}
+	settleRawFields(v)
 	return
 }
 
@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// An ExtraKind names the message whose Extra field a type is registered for
+type ExtraKind string
+
+const (
+	AuthExtra       ExtraKind = "Auth"
+	AuthRespExtra   ExtraKind = "AuthResp"
+	BindExtra       ExtraKind = "Bind"
+	BindRespExtra   ExtraKind = "BindResp"
+	UnbindExtra     ExtraKind = "Unbind"
+	UnbindRespExtra ExtraKind = "UnbindResp"
+)
+
+// A Validator is a registered options or Extra type which checks its values
+// once they are decoded. A value which fails validation is rejected before
+// the application sees it.
+type Validator interface {
+	Validate() error
+}
+
+// registry holds the types registered for the Options of each protocol and each kind of Extra
+var registry = struct {
+	sync.RWMutex
+	options map[string]reflect.Type
+	extra   map[ExtraKind]reflect.Type
+}{
+	options: make(map[string]reflect.Type),
+	extra:   make(map[ExtraKind]reflect.Type),
+}
+
+func init() {
+	RegisterOptions("http", HTTPOptions{})
+	RegisterOptions("https", HTTPOptions{})
+	RegisterOptions("tcp", TCPOptions{})
+	RegisterOptions("tls", TLSOptions{})
+}
+
+// RegisterOptions registers the type of the Bind.Options of protocol. options is
+// a value of the type, or a pointer to one, e.g. MyOptions{}. Options received for
+// the protocol are decoded into a pointer to a new value of the type, e.g. a
+// *MyOptions. Registering a type for a protocol again replaces the previous one,
+// including the types registered for the built-in protocols http, https, tcp and tls.
+func RegisterOptions(protocol string, options interface{}) {
+	t := registrableType(options)
+
+	registry.Lock()
+	defer registry.Unlock()
+	registry.options[protocol] = t
+}
+
+// RegisterExtra registers the type of the Extra field of the messages of the given kind,
+// like RegisterOptions does for Bind.Options
+func RegisterExtra(kind ExtraKind, extra interface{}) {
+	t := registrableType(extra)
+
+	registry.Lock()
+	defer registry.Unlock()
+	registry.extra[kind] = t
+}
+
+func registrableType(value interface{}) reflect.Type {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		panic("proto: Cannot register the type of nil")
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// DecodeOptions decodes options received for a tunnel of the given protocol into a
+// pointer to the type registered for the protocol and validates it. Missing options
+// decode to the type's zero value. Options of protocols without a registered type are
+// returned as they are.
+func DecodeOptions(protocol string, options interface{}) (interface{}, error) {
+	registry.RLock()
+	t, ok := registry.options[protocol]
+	registry.RUnlock()
+
+	if !ok {
+		return options, nil
+	}
+	return decodeRegistered(t, options)
+}
+
+// DecodeExtra decodes the Extra field of a message of the given kind into a pointer to
+// the type registered for the kind and validates it. A missing Extra stays nil. Extras
+// without a registered type are returned as they are.
+func DecodeExtra(kind ExtraKind, extra interface{}) (interface{}, error) {
+	registry.RLock()
+	t, ok := registry.extra[kind]
+	registry.RUnlock()
+
+	if !ok || extra == nil {
+		return extra, nil
+	}
+	return decodeRegistered(t, extra)
+}
+
+// DecodeBind decodes the Options and Extra of bind into their registered types
+func DecodeBind(bind *Bind) (err error) {
+	if bind.Options, err = DecodeOptions(bind.Protocol, bind.Options); err != nil {
+		return fmt.Errorf("Invalid options for %s tunnel: %v", bind.Protocol, err)
+	}
+	if bind.Extra, err = DecodeExtra(BindExtra, bind.Extra); err != nil {
+		return fmt.Errorf("Invalid bind extra: %v", err)
+	}
+	return nil
+}
+
+func decodeRegistered(t reflect.Type, value interface{}) (interface{}, error) {
+	decoded := reflect.New(t).Interface()
+	if value != nil {
+		if err := UnpackInterfaceField(value, decoded); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := decoded.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
@@ -1,3 +1,19 @@
 package proto
 
 const Version = "1"
+
+// Versions lists the protocol versions this implementation speaks
+var Versions = []string{Version}
+
+// ChooseVersion returns the first of the versions a client requested which this
+// implementation speaks, honoring the client's order of preference
+func ChooseVersion(requested []string) (string, bool) {
+	for _, v := range requested {
+		for _, supported := range Versions {
+			if v == supported {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminSession is the representation of a Session served by the admin API. It leaves
+// out the client's Auth message, whose Extra usually holds the client's credentials.
+type adminSession struct {
+	Id           string
+	RemoteAddr   string
+	Start        time.Time
+	Identity     *Identity
+	Certificate  *adminCertificate
+	Capabilities []string
+	Tunnels      []*adminTunnel
+}
+
+// adminCertificate is the representation of a PeerCertificate served by the admin API
+type adminCertificate struct {
+	Subject     string
+	Fingerprint string
+}
+
+// adminTunnel is the representation of a Tunnel served by the admin API. Its Options
+// leave out the credentials which protect http and https tunnels.
+type adminTunnel struct {
+	Url         string
+	Protocol    string
+	Options     interface{}
+	Start       time.Time
+	Connections int64
+}
+
+func newAdminSession(sess *Session) *adminSession {
+	s := &adminSession{
+		Id:           sess.Id(),
+		RemoteAddr:   sess.RemoteAddr().String(),
+		Start:        sess.Start(),
+		Identity:     sess.Identity(),
+		Capabilities: make([]string, 0),
+		Tunnels:      make([]*adminTunnel, 0),
+	}
+
+	for name := range sess.Capabilities() {
+		s.Capabilities = append(s.Capabilities, name)
+	}
+	sort.Strings(s.Capabilities)
+
+	if cert := sess.PeerCertificate(); cert != nil {
+		s.Certificate = &adminCertificate{Subject: cert.Subject.String(), Fingerprint: cert.Fingerprint}
+	}
+
+	tunnels := sess.Tunnels()
+	sort.Sort(byTunnelStart(tunnels))
+	for _, t := range tunnels {
+		s.Tunnels = append(s.Tunnels, newAdminTunnel(t))
+	}
+	return s
+}
+
+func newAdminTunnel(t *Tunnel) *adminTunnel {
+	return &adminTunnel{
+		Url:         t.Url(),
+		Protocol:    t.Bind().Protocol,
+		Options:     adminOptions(t.Bind().Options),
+		Start:       t.Start(),
+		Connections: t.Connections(),
+	}
+}
+
+// adminOptions returns the bind options of a tunnel as a JSON object without the
+// Auth field of HTTPOptions, or nil if they aren't an object
+func adminOptions(options interface{}) map[string]interface{} {
+	var opts map[string]interface{}
+	if err := proto.UnpackInterfaceField(options, &opts); err != nil {
+		return nil
+	}
+	delete(opts, "Auth")
+	return opts
+}
+
+// adminHandler serves the admin API for a Server
+type adminHandler struct {
+	server *Server
+}
+
+// AdminHandler returns an http.Handler which serves an API for inspecting and managing the
+// server's live sessions and tunnels. It is intended to be mounted on a private interface,
+// optionally under a prefix with http.StripPrefix. Responses are JSON encoded.
+//
+//	GET    /sessions                         list all sessions and their tunnels
+//	GET    /sessions/<id>                    show a single session
+//	DELETE /sessions/<id>                    forcibly shut down a session
+//	DELETE /sessions/<id>/tunnels?url=<url>  unbind a single tunnel of a session
+func (s *Server) AdminHandler() http.Handler {
+	return &adminHandler{server: s}
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "sessions" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch len(parts) {
+	case 1:
+		h.handleSessions(w, r)
+	case 2:
+		h.handleSession(w, r, parts[1])
+	case 3:
+		if parts[2] != "tunnels" {
+			http.NotFound(w, r)
+			return
+		}
+		h.handleTunnels(w, r, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *adminHandler) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+
+	sessions := h.server.registry.sessions()
+	sort.Sort(bySessionStart(sessions))
+
+	resp := make([]*adminSession, 0, len(sessions))
+	for _, sess := range sessions {
+		resp = append(resp, newAdminSession(sess))
+	}
+	writeJSON(w, resp)
+}
+
+func (h *adminHandler) handleSession(w http.ResponseWriter, r *http.Request, id string) {
+	sess, ok := h.server.registry.get(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, newAdminSession(sess))
+	case "DELETE":
+		h.server.Info("Shutting down session %s by admin request from %s", id, r.RemoteAddr)
+		sess.Shutdown()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+func (h *adminHandler) handleTunnels(w http.ResponseWriter, r *http.Request, id string) {
+	sess, ok := h.server.registry.get(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, newAdminSession(sess).Tunnels)
+	case "DELETE":
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "Missing url parameter", http.StatusBadRequest)
+			return
+		}
+
+		h.server.Info("Unbinding tunnel %s of session %s by admin request from %s", url, id, r.RemoteAddr)
+		if err := sess.CloseTunnel(url, "Unbound by an operator"); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+type bySessionStart []*Session
+
+func (s bySessionStart) Len() int           { return len(s) }
+func (s bySessionStart) Less(i, j int) bool { return s[i].Start().Before(s[j].Start()) }
+func (s bySessionStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byTunnelStart []*Tunnel
+
+func (t byTunnelStart) Len() int           { return len(t) }
+func (t byTunnelStart) Less(i, j int) bool { return t[i].Start().Before(t[j].Start()) }
+func (t byTunnelStart) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
@@ -26,25 +26,46 @@ type vhostMuxer interface {
 }
 
 type HTTPBinder struct {
-	mux            vhostMuxer // muxer
-	publicBaseAddr string     // public host or host:port address used in creating the returned URLs when binding
-	proto          string     // http or https
+	mux            vhostMuxer   // muxer
+	listener       net.Listener // listener the muxer accepts public connections from
+	publicBaseAddr string       // public host or host:port address used in creating the returned URLs when binding
+	proto          string       // http or https
+
+	// Reservations, if set, restricts who may bind reserved hostnames
+	Reservations Reservations
 }
 
 func (b *HTTPBinder) Bind(rawOpts interface{}) (net.Listener, string, error) {
+	return b.BindOwner("", rawOpts)
+}
+
+func (b *HTTPBinder) BindOwner(owner string, rawOpts interface{}) (net.Listener, string, error) {
 	var opts proto.HTTPOptions
 	if err := proto.UnpackInterfaceField(rawOpts, &opts); err != nil {
 		return nil, "", err
 	}
 
-	return b.BindOpts(&opts)
+	return b.BindOptsOwner(owner, &opts)
 }
 
-func (b *HTTPBinder) BindOpts(opts *proto.HTTPOptions) (listener net.Listener, url string, err error) {
+func (b *HTTPBinder) BindOpts(opts *proto.HTTPOptions) (net.Listener, string, error) {
+	return b.BindOptsOwner("", opts)
+}
+
+func (b *HTTPBinder) BindOptsOwner(owner string, opts *proto.HTTPOptions) (listener net.Listener, url string, err error) {
 	for i := 0; i < maxRandomAttempts; i++ {
 		// pick a name
 		hostname, isRandom := pickName(opts.Hostname, opts.Subdomain, b.publicBaseAddr)
 
+		// make sure it isn't reserved for someone else
+		if err = checkHost(b.Reservations, owner, hostname, isRandom); err != nil {
+			if !isRandom {
+				return
+			} else {
+				continue
+			}
+		}
+
 		// bind it - this could fail if the requested hostname is already bound
 		if listener, err = b.mux.Listen(hostname); err != nil {
 			// only try again if we're picking names at random
@@ -70,6 +91,11 @@ func (b *HTTPBinder) BindOpts(opts *proto.HTTPOptions) (listener net.Listener, u
 	return
 }
 
+// Close stops the binder from accepting public connections for any of its tunnels
+func (b *HTTPBinder) Close() error {
+	return b.listener.Close()
+}
+
 const (
 	httpResponseTemplate = `HTTP/1.0 %s
 Content-Length: %d
@@ -108,10 +134,11 @@ func (b *HTTPBinder) handleMuxErrors() {
 	}
 }
 
-func sharedInit(mux vhostMuxer, protocol, publicBaseAddr string) (*HTTPBinder, error) {
+func sharedInit(mux vhostMuxer, listener net.Listener, protocol, publicBaseAddr string) (*HTTPBinder, error) {
 	// make the binder
 	binder := &HTTPBinder{
 		mux:            mux,
+		listener:       listener,
 		publicBaseAddr: normalize(publicBaseAddr),
 		proto:          protocol,
 	}
@@ -135,7 +162,7 @@ func NewHTTPBinder(addr, publicBaseAddr string, muxTimeout time.Duration) (*HTTP
 		return nil, err
 	}
 
-	return sharedInit(mux, "http", publicBaseAddr)
+	return sharedInit(mux, listener, "http", publicBaseAddr)
 }
 
 func NewHTTPSBinder(addr, publicBaseAddr string, muxTimeout time.Duration, tlsConfig *tls.Config) (*HTTPBinder, error) {
@@ -151,7 +178,7 @@ func NewHTTPSBinder(addr, publicBaseAddr string, muxTimeout time.Duration, tlsCo
 		return nil, err
 	}
 
-	return sharedInit(mux, "https", publicBaseAddr)
+	return sharedInit(mux, listener, "https", publicBaseAddr)
 }
 
 // XXX: perhaps this shouldn't be part of a binder
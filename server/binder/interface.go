@@ -25,6 +25,18 @@ func pickName(hostname, subdomain, publicBaseAddr string) (url string, israndom
 	}
 }
 
+// A Binder binds tunnels of a protocol. Bind receives the options of the client's Bind
+// message decoded into the type registered for the protocol with proto.RegisterOptions,
+// e.g. a *proto.HTTPOptions, and already validated if the type is a proto.Validator.
+// Options of protocols without a registered type are passed as a proto.RawValue.
 type Binder interface {
 	Bind(interface{}) (net.Listener, string, error)
 }
+
+// An OwnerBinder is a Binder which honors Reservations. BindOwner binds on behalf
+// of the named owner, typically the identity the client's session authenticated as,
+// so that it may bind the hostnames and ports reserved for it.
+type OwnerBinder interface {
+	Binder
+	BindOwner(owner string, opts interface{}) (net.Listener, string, error)
+}
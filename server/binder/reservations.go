@@ -0,0 +1,271 @@
+package binder
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reservations maps hostnames and TCP ports to the identity which owns them.
+// Binders with reservations only let the owner bind a reserved hostname or port
+// and never hand one out when picking a name or port at random.
+type Reservations interface {
+	// HostOwner returns the owner of hostname if it is reserved
+	HostOwner(hostname string) (owner string, reserved bool)
+
+	// PortOwner returns the owner of a TCP port if it is reserved
+	PortOwner(port int) (owner string, reserved bool)
+}
+
+// FileReservations is a Reservations store backed by a file.
+//
+// Each line of the file holds a reserved name and the identity which owns it,
+// separated by whitespace. A name is either a hostname, a hostname pattern in
+// the syntax of path.Match which reserves a whole set of subdomains, or a TCP
+// port. Blank lines and lines starting with # are ignored:
+//
+//	# name                  owner
+//	alice.example.com       alice
+//	*.acme.example.com      acme
+//	22000                   bob
+type FileReservations struct {
+	path string
+
+	sync.RWMutex
+	hosts    map[string]string // hostname -> owner
+	patterns [][2]string       // hostname pattern, owner; in the order they appear in the file
+	ports    map[int]string    // port -> owner
+}
+
+// NewFileReservations loads the reservations in the file at path.
+// The file is created if it does not exist.
+func NewFileReservations(path string) (*FileReservations, error) {
+	r := &FileReservations{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the reservations file again, replacing all of the reservations previously loaded
+func (r *FileReservations) Reload() error {
+	f, err := os.OpenFile(r.path, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hosts, ports := make(map[string]string), make(map[int]string)
+	patterns := make([][2]string, 0)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected a name and an owner", r.path, lineno)
+		}
+
+		name, owner := normalize(fields[0]), fields[1]
+		port, isPort, err := parseReservedName(name)
+		switch {
+		case err != nil:
+			return fmt.Errorf("%s:%d: %v", r.path, lineno, err)
+		case isPort:
+			ports[port] = owner
+		case strings.ContainsAny(name, "*?["):
+			patterns = append(patterns, [2]string{name, owner})
+		default:
+			hosts[name] = owner
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.hosts, r.patterns, r.ports = hosts, patterns, ports
+	return nil
+}
+
+// parseReservedName reports whether name is a TCP port or validates it as a hostname pattern
+func parseReservedName(name string) (port int, isPort bool, err error) {
+	if port, err = strconv.Atoi(name); err == nil {
+		if port <= 0 || port > 65535 {
+			return 0, false, fmt.Errorf("bad port %d", port)
+		}
+		return port, true, nil
+	}
+
+	if _, err = path.Match(name, ""); err != nil {
+		return 0, false, fmt.Errorf("bad hostname pattern %q", name)
+	}
+	return 0, false, nil
+}
+
+func (r *FileReservations) HostOwner(hostname string) (string, bool) {
+	hostname = normalize(hostname)
+
+	// reservations are for hostnames, regardless of the port they are served on
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		hostname = host
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	if owner, ok := r.hosts[hostname]; ok {
+		return owner, true
+	}
+
+	for _, p := range r.patterns {
+		if ok, _ := path.Match(p[0], hostname); ok {
+			return p[1], true
+		}
+	}
+	return "", false
+}
+
+func (r *FileReservations) PortOwner(port int) (string, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	owner, ok := r.ports[port]
+	return owner, ok
+}
+
+// Reserve reserves name, a hostname, hostname pattern or TCP port, for owner
+// and saves the reservations file. Comments in the file are not preserved.
+func (r *FileReservations) Reserve(name, owner string) error {
+	name = normalize(name)
+	port, isPort, err := parseReservedName(name)
+	if err != nil {
+		return err
+	}
+	if owner == "" || strings.ContainsAny(owner, " \t\n") {
+		return fmt.Errorf("Bad owner %q", owner)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	switch {
+	case isPort:
+		if current, ok := r.ports[port]; ok && current != owner {
+			return fmt.Errorf("Port %d is already reserved by %s", port, current)
+		}
+		r.ports[port] = owner
+	case strings.ContainsAny(name, "*?["):
+		for _, p := range r.patterns {
+			if p[0] == name {
+				return fmt.Errorf("%s is already reserved by %s", name, p[1])
+			}
+		}
+		r.patterns = append(r.patterns, [2]string{name, owner})
+	default:
+		if current, ok := r.hosts[name]; ok && current != owner {
+			return fmt.Errorf("%s is already reserved by %s", name, current)
+		}
+		r.hosts[name] = owner
+	}
+
+	return r.save()
+}
+
+// Release removes the reservation of name and saves the reservations file.
+// Comments in the file are not preserved.
+func (r *FileReservations) Release(name string) error {
+	name = normalize(name)
+	port, isPort, err := parseReservedName(name)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if isPort {
+		delete(r.ports, port)
+	} else {
+		delete(r.hosts, name)
+		for i, p := range r.patterns {
+			if p[0] == name {
+				r.patterns = append(r.patterns[:i], r.patterns[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return r.save()
+}
+
+// save atomically replaces the reservations file with the current reservations.
+// The caller must hold the lock.
+func (r *FileReservations) save() error {
+	lines := make([]string, 0, len(r.hosts)+len(r.ports))
+	for host, owner := range r.hosts {
+		lines = append(lines, fmt.Sprintf("%s %s", host, owner))
+	}
+	for port, owner := range r.ports {
+		lines = append(lines, fmt.Sprintf("%d %s", port, owner))
+	}
+	sort.Strings(lines)
+
+	// patterns are matched in order, so they must stay in the order they were added
+	for _, p := range r.patterns {
+		lines = append(lines, fmt.Sprintf("%s %s", p[0], p[1]))
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// checkHost returns an error if hostname is reserved for someone other than owner.
+// Names picked at random are rejected if they are reserved at all.
+func checkHost(res Reservations, owner, hostname string, isRandom bool) error {
+	if res == nil {
+		return nil
+	}
+
+	if reservedBy, ok := res.HostOwner(hostname); ok && (isRandom || reservedBy != owner) {
+		return fmt.Errorf("Hostname %s is reserved", hostname)
+	}
+	return nil
+}
+
+// checkPort returns an error if port is reserved for someone other than owner.
+// Ports picked at random are rejected if they are reserved at all.
+func checkPort(res Reservations, owner string, port int, isRandom bool) error {
+	if res == nil {
+		return nil
+	}
+
+	if reservedBy, ok := res.PortOwner(port); ok && (isRandom || reservedBy != owner) {
+		return fmt.Errorf("Port %d is reserved", port)
+	}
+	return nil
+}
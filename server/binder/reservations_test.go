@@ -0,0 +1,272 @@
+package binder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testReservations = `# name                  owner
+alice.example.com       alice
+Bob.Example.com         bob
+
+*.acme.example.com      acme
+*.example.com           catchall
+22000                   bob
+`
+
+func newTestReservations(t *testing.T, contents string) (*FileReservations, string) {
+	dir, err := ioutil.TempDir("", "reservations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "reservations")
+	if err = ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewFileReservations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, path
+}
+
+func TestFileReservationsLookup(t *testing.T) {
+	r, _ := newTestReservations(t, testReservations)
+
+	hosts := []struct {
+		hostname string
+		owner    string
+	}{
+		{"alice.example.com", "alice"},
+		{"ALICE.example.com ", "alice"},
+		{"alice.example.com:8080", "alice"},
+		{"bob.example.com", "bob"},
+		{"x.acme.example.com", "acme"},
+		{"anything.example.com", "catchall"},
+		{"example.com", ""},
+		{"other.org", ""},
+	}
+	for _, tt := range hosts {
+		owner, reserved := r.HostOwner(tt.hostname)
+		if owner != tt.owner || reserved != (tt.owner != "") {
+			t.Errorf("HostOwner(%q) = %q, %v, want %q", tt.hostname, owner, reserved, tt.owner)
+		}
+	}
+
+	if owner, reserved := r.PortOwner(22000); !reserved || owner != "bob" {
+		t.Errorf("PortOwner(22000) = %q, %v, want bob", owner, reserved)
+	}
+	if _, reserved := r.PortOwner(22001); reserved {
+		t.Error("port 22001 is reserved")
+	}
+}
+
+func TestFileReservationsCreatesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reservations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "reservations")
+	r, err := NewFileReservations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, reserved := r.HostOwner("alice.example.com"); reserved {
+		t.Error("empty reservations reserve a hostname")
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("reservations file was not created: %v", err)
+	}
+}
+
+func TestFileReservationsInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{"missing owner", "alice.example.com\n", ":1: expected a name and an owner"},
+		{"extra field", "# comment\nalice.example.com alice bob\n", ":2: expected a name and an owner"},
+		{"port zero", "0 alice\n", "bad port 0"},
+		{"port too large", "65536 alice\n", "bad port 65536"},
+		{"bad pattern", "[.example.com alice\n", "bad hostname pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "reservations")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "reservations")
+			if err = ioutil.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = NewFileReservations(path); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFileReservationsReload(t *testing.T) {
+	r, path := newTestReservations(t, testReservations)
+
+	if err := ioutil.WriteFile(path, []byte("carol.example.com carol\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := r.HostOwner("carol.example.com"); owner != "carol" {
+		t.Errorf("new reservation is owned by %q, want carol", owner)
+	}
+	if _, reserved := r.HostOwner("alice.example.com"); reserved {
+		t.Error("reservation removed from the file is still loaded")
+	}
+	if _, reserved := r.PortOwner(22000); reserved {
+		t.Error("port reservation removed from the file is still loaded")
+	}
+
+	// a broken file leaves the loaded reservations in place
+	if err := ioutil.WriteFile(path, []byte("broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("reloaded a broken file")
+	}
+	if owner, _ := r.HostOwner("carol.example.com"); owner != "carol" {
+		t.Error("failed reload dropped the loaded reservations")
+	}
+}
+
+func TestFileReservationsReserve(t *testing.T) {
+	r, path := newTestReservations(t, testReservations)
+
+	tests := []struct {
+		name  string
+		owner string
+		err   string
+	}{
+		{"carol.example.com", "carol", ""},
+		{"Alice.Example.com", "alice", ""},
+		{"alice.example.com", "carol", "already reserved by alice"},
+		{"22000", "alice", "Port 22000 is already reserved by bob"},
+		{"22001", "alice", ""},
+		{"*.acme.example.com", "acme", "already reserved by acme"},
+		{"*.carol.org", "carol", ""},
+		{"70000", "alice", "bad port 70000"},
+		{"[", "alice", "bad hostname pattern"},
+		{"dave.example.com", "", "Bad owner"},
+		{"dave.example.com", "dave smith", "Bad owner"},
+	}
+	for _, tt := range tests {
+		err := r.Reserve(tt.name, tt.owner)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("Reserve(%q, %q) failed: %v", tt.name, tt.owner, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("Reserve(%q, %q) got error %v, want one containing %q", tt.name, tt.owner, err, tt.err)
+		}
+	}
+
+	if owner, _ := r.HostOwner("x.carol.org"); owner != "carol" {
+		t.Errorf("reserved pattern is owned by %q, want carol", owner)
+	}
+
+	// the reservations were saved and survive loading the file again
+	saved, err := NewFileReservations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hostname, owner := range map[string]string{
+		"carol.example.com":  "carol",
+		"x.carol.org":        "carol",
+		"x.acme.example.com": "acme",
+		"bob.example.com":    "bob",
+	} {
+		if got, _ := saved.HostOwner(hostname); got != owner {
+			t.Errorf("saved %s is owned by %q, want %q", hostname, got, owner)
+		}
+	}
+	if owner, _ := saved.PortOwner(22001); owner != "alice" {
+		t.Errorf("saved port 22001 is owned by %q, want alice", owner)
+	}
+
+	// patterns are matched in order, so new patterns must be saved after the old ones
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if last := lines[len(lines)-1]; last != "*.carol.org carol" {
+		t.Errorf("last line of the saved file is %q, want the newest pattern", last)
+	}
+}
+
+func TestFileReservationsRelease(t *testing.T) {
+	r, path := newTestReservations(t, testReservations)
+
+	for _, name := range []string{"ALICE.example.com", "22000", "*.acme.example.com", "unreserved.org"} {
+		if err := r.Release(name); err != nil {
+			t.Fatalf("Release(%q) failed: %v", name, err)
+		}
+	}
+	if err := r.Release("0"); err == nil {
+		t.Error("released a bad port")
+	}
+
+	saved, err := NewFileReservations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range []*FileReservations{r, saved} {
+		if owner, _ := res.HostOwner("alice.example.com"); owner != "catchall" {
+			t.Errorf("released hostname is owned by %q, want the matching pattern's owner", owner)
+		}
+		if _, reserved := res.PortOwner(22000); reserved {
+			t.Error("released port is still reserved")
+		}
+		if owner, _ := res.HostOwner("x.acme.example.com"); owner != "catchall" {
+			t.Errorf("subdomain of a released pattern is owned by %q, want the next pattern's owner", owner)
+		}
+		if owner, _ := res.HostOwner("bob.example.com"); owner != "bob" {
+			t.Errorf("unreleased hostname is owned by %q, want bob", owner)
+		}
+	}
+}
+
+func TestCheckReservations(t *testing.T) {
+	r, _ := newTestReservations(t, testReservations)
+
+	tests := []struct {
+		name     string
+		err      error
+		wantFail bool
+	}{
+		{"owner", checkHost(r, "alice", "alice.example.com", false), false},
+		{"other owner", checkHost(r, "bob", "alice.example.com", false), true},
+		{"random reserved", checkHost(r, "alice", "alice.example.com", true), true},
+		{"unreserved", checkHost(r, "bob", "free.org", true), false},
+		{"no reservations", checkHost(nil, "bob", "alice.example.com", false), false},
+		{"port owner", checkPort(r, "bob", 22000, false), false},
+		{"port other owner", checkPort(r, "alice", 22000, false), true},
+		{"random reserved port", checkPort(r, "bob", 22000, true), true},
+		{"no port reservations", checkPort(nil, "alice", 22000, false), false},
+	}
+	for _, tt := range tests {
+		if (tt.err != nil) != tt.wantFail {
+			t.Errorf("%s: got error %v, want failure %v", tt.name, tt.err, tt.wantFail)
+		}
+	}
+}
@@ -20,13 +20,13 @@ func NewReverseProxyBinder(addr, publicBaseAddr string, muxTimeout time.Duration
 	}
 
 	httpMux := &httpReverseProxyMuxer{VhostMuxer: mux, proto: "http"}
-	httpBinder, err = sharedInit(httpMux, "http", publicBaseAddr)
+	httpBinder, err = sharedInit(httpMux, listener, "http", publicBaseAddr)
 	if err != nil {
 		return
 	}
 
 	httpsMux := &httpReverseProxyMuxer{VhostMuxer: mux, proto: "https"}
-	httpsBinder, err = sharedInit(httpsMux, "https", publicBaseAddr)
+	httpsBinder, err = sharedInit(httpsMux, listener, "https", publicBaseAddr)
 	if err != nil {
 		return
 	}
@@ -10,33 +10,63 @@ import (
 type TCPBinder struct {
 	iface    net.IP // the interface to bind TCP ports on
 	hostname string // a public hostname of the address where the ports are bound
+
+	// Reservations, if set, restricts who may bind reserved ports
+	Reservations Reservations
 }
 
 func (b *TCPBinder) Bind(rawOpts interface{}) (net.Listener, string, error) {
+	return b.BindOwner("", rawOpts)
+}
+
+func (b *TCPBinder) BindOwner(owner string, rawOpts interface{}) (net.Listener, string, error) {
 	var opts proto.TCPOptions
 	if err := proto.UnpackInterfaceField(rawOpts, &opts); err != nil {
 		return nil, "", err
 	}
 
-	return b.BindOpts(&opts)
+	return b.BindOptsOwner(owner, &opts)
+}
+
+func (b *TCPBinder) BindOpts(opts *proto.TCPOptions) (net.Listener, string, error) {
+	return b.BindOptsOwner("", opts)
 }
 
-func (b *TCPBinder) BindOpts(opts *proto.TCPOptions) (listener net.Listener, url string, err error) {
-	// create the listening address
-	listenAddr := &net.TCPAddr{
-		IP:   b.iface,
-		Port: int(opts.RemotePort),
+func (b *TCPBinder) BindOptsOwner(owner string, opts *proto.TCPOptions) (listener net.Listener, url string, err error) {
+	isRandom := opts.RemotePort == 0
+	if !isRandom {
+		if err = checkPort(b.Reservations, owner, int(opts.RemotePort), false); err != nil {
+			return
+		}
 	}
 
-	// bind a new tcp port
-	if listener, err = net.ListenTCP("tcp", listenAddr); err != nil {
+	for i := 0; i < maxRandomAttempts; i++ {
+		// create the listening address
+		listenAddr := &net.TCPAddr{
+			IP:   b.iface,
+			Port: int(opts.RemotePort),
+		}
+
+		// bind a new tcp port
+		if listener, err = net.ListenTCP("tcp", listenAddr); err != nil {
+			return
+		}
+
+		// we ask the listener what port it bound in case
+		// the client supplied port 0 and the OS picked one at random
+		addr := listener.Addr().(*net.TCPAddr)
+
+		// the OS doesn't know about reservations, so try again if it picked a reserved port
+		if err = checkPort(b.Reservations, owner, addr.Port, isRandom); err != nil {
+			listener.Close()
+			continue
+		}
+
+		url = fmt.Sprintf("tcp://%s:%d", b.hostname, addr.Port)
 		return
 	}
 
-	// we ask the listener what port it bound in case
-	// the client supplied port 0 and the OS picked one at random
-	addr := listener.Addr().(*net.TCPAddr)
-	url = fmt.Sprintf("tcp://%s:%d", b.hostname, addr.Port)
+	err = fmt.Errorf("Failed to assign random port")
 	return
 }
 
@@ -9,8 +9,12 @@ import (
 )
 
 type TLSBinder struct {
-	mux            vhostMuxer // muxer
-	publicBaseAddr string     // public host or host:port address used in creating the returned URLs when binding
+	mux            vhostMuxer   // muxer
+	listener       net.Listener // listener the muxer accepts public connections from
+	publicBaseAddr string       // public host or host:port address used in creating the returned URLs when binding
+
+	// Reservations, if set, restricts who may bind reserved hostnames
+	Reservations Reservations
 }
 
 func NewTLSBinder(addr, publicBaseAddr string, muxTimeout time.Duration) (*TLSBinder, error) {
@@ -26,6 +30,7 @@ func NewTLSBinder(addr, publicBaseAddr string, muxTimeout time.Duration) (*TLSBi
 
 	binder := &TLSBinder{
 		mux:            mux,
+		listener:       listener,
 		publicBaseAddr: publicBaseAddr,
 	}
 
@@ -34,20 +39,42 @@ func NewTLSBinder(addr, publicBaseAddr string, muxTimeout time.Duration) (*TLSBi
 	return binder, nil
 }
 
+// Close stops the binder from accepting public connections for any of its tunnels
+func (b *TLSBinder) Close() error {
+	return b.listener.Close()
+}
+
 func (b *TLSBinder) Bind(rawOpts interface{}) (net.Listener, string, error) {
+	return b.BindOwner("", rawOpts)
+}
+
+func (b *TLSBinder) BindOwner(owner string, rawOpts interface{}) (net.Listener, string, error) {
 	var opts proto.TLSOptions
 	if err := proto.UnpackInterfaceField(rawOpts, &opts); err != nil {
 		return nil, "", err
 	}
 
-	return b.BindOpts(&opts)
+	return b.BindOptsOwner(owner, &opts)
+}
+
+func (b *TLSBinder) BindOpts(opts *proto.TLSOptions) (net.Listener, string, error) {
+	return b.BindOptsOwner("", opts)
 }
 
-func (b *TLSBinder) BindOpts(opts *proto.TLSOptions) (listener net.Listener, url string, err error) {
+func (b *TLSBinder) BindOptsOwner(owner string, opts *proto.TLSOptions) (listener net.Listener, url string, err error) {
 	for i := 0; i < maxRandomAttempts; i++ {
 		// pick a name
 		hostname, isRandom := pickName(opts.Hostname, opts.Subdomain, b.publicBaseAddr)
 
+		// make sure it isn't reserved for someone else
+		if err = checkHost(b.Reservations, owner, hostname, isRandom); err != nil {
+			if !isRandom {
+				return
+			} else {
+				continue
+			}
+		}
+
 		// bind it - this could fail if the requested hostname is already bound
 		if listener, err = b.mux.Listen(hostname); err != nil {
 			// only try again if we're picking names at random
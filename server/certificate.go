@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"net/url"
+)
+
+// A PeerCertificate describes the certificate a client presented when it connected over
+// TLS and which the server verified against its ClientCAs. SessionHooks.OnAuth may use
+// it to decide who the client is instead of relying on a secret in the Auth message.
+type PeerCertificate struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+
+	// Fingerprint is the hex encoded SHA-256 hash of the DER encoded certificate
+	Fingerprint string
+
+	// Certificate is the parsed certificate itself
+	Certificate *x509.Certificate
+}
+
+// peerCertificate returns the verified certificate of a TLS client, or nil if the client
+// did not present one or the server did not verify it
+func peerCertificate(state *tls.ConnectionState) *PeerCertificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &PeerCertificate{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Fingerprint:    hex.EncodeToString(fingerprint[:]),
+		Certificate:    cert,
+	}
+}
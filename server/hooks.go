@@ -12,6 +12,13 @@ func (*NoopSessionHooks) OnAuth(*Session, *proto.Auth) error { return nil }
 func (*NoopSessionHooks) OnBind(*Session, *proto.Bind) error { return nil }
 func (*NoopSessionHooks) OnClose(*Session) error             { return nil }
 
+// HeartbeatHooks may be implemented by SessionHooks to learn the round trip time
+// of every heartbeat a client answers, see Server.HeartbeatInterval. If OnHeartbeat
+// returns an error, the session's connection is closed.
+type HeartbeatHooks interface {
+	OnHeartbeat(*Session, time.Duration) error
+}
+
 type NoopTunnelHooks int
 
 func (*NoopTunnelHooks) OnConnectionOpen(*Tunnel, conn.Conn) error { return nil }
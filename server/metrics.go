@@ -0,0 +1,288 @@
+package server
+
+import (
+	"fmt"
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const metricsPrefix = "gotunnel_"
+
+// counterVec is a set of monotonically increasing counters keyed by a single label value
+type counterVec struct {
+	sync.Mutex
+	values map[string]int64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]int64)}
+}
+
+func (c *counterVec) add(label string, delta int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[label] += delta
+}
+
+func (c *counterVec) snapshot() map[string]int64 {
+	c.Lock()
+	defer c.Unlock()
+	values := make(map[string]int64, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	return values
+}
+
+// metrics counts the events that happen over the lifetime of a Server.
+// Counters that are broken down by protocol survive the tunnels they count,
+// per-tunnel values are read from the live tunnels at collection time.
+// A nil *metrics counts nothing, so sessions work without a Server's metrics.
+type metrics struct {
+	sessionsAccepted int64
+	authFailures     int64
+	activeConns      int64
+	binds            *counterVec // by protocol
+	bindFailures     *counterVec // by protocol
+	unbinds          *counterVec // by protocol
+	connsOpened      *counterVec // by protocol
+	connsClosed      *counterVec // by protocol
+	bytesIn          *counterVec // by protocol
+	bytesOut         *counterVec // by protocol
+	proxyFailures    *counterVec // by protocol
+	readFailures     *counterVec // by reason
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		binds:         newCounterVec(),
+		bindFailures:  newCounterVec(),
+		unbinds:       newCounterVec(),
+		connsOpened:   newCounterVec(),
+		connsClosed:   newCounterVec(),
+		bytesIn:       newCounterVec(),
+		bytesOut:      newCounterVec(),
+		proxyFailures: newCounterVec(),
+		readFailures:  newCounterVec(),
+	}
+}
+
+func (m *metrics) sessionAccepted() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sessionsAccepted, 1)
+}
+
+func (m *metrics) authFailed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.authFailures, 1)
+}
+
+func (m *metrics) bound(protocol string) {
+	if m == nil {
+		return
+	}
+	m.binds.add(protocol, 1)
+}
+
+func (m *metrics) bindFailed(protocol string) {
+	if m == nil {
+		return
+	}
+	m.bindFailures.add(protocol, 1)
+}
+
+func (m *metrics) unbound(protocol string) {
+	if m == nil {
+		return
+	}
+	m.unbinds.add(protocol, 1)
+}
+
+func (m *metrics) connOpened(t *Tunnel) {
+	atomic.AddInt64(&t.connsOpened, 1)
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.activeConns, 1)
+	m.connsOpened.add(t.req.Protocol, 1)
+}
+
+func (m *metrics) connClosed(t *Tunnel, bytesIn, bytesOut int64) {
+	atomic.AddInt64(&t.connsClosed, 1)
+	atomic.AddInt64(&t.bytesIn, bytesIn)
+	atomic.AddInt64(&t.bytesOut, bytesOut)
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.activeConns, -1)
+	m.connsClosed.add(t.req.Protocol, 1)
+	m.bytesIn.add(t.req.Protocol, bytesIn)
+	m.bytesOut.add(t.req.Protocol, bytesOut)
+}
+
+// active returns the number of public connections currently being proxied
+func (m *metrics) active() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.activeConns)
+}
+
+func (m *metrics) proxyFailed(t *Tunnel) {
+	if m == nil {
+		return
+	}
+	m.proxyFailures.add(t.req.Protocol, 1)
+}
+
+// readFailed counts control messages from clients which violated the server's limits
+func (m *metrics) readFailed(err error) {
+	if m == nil {
+		return
+	}
+	switch err.(type) {
+	case *proto.MsgSizeError:
+		m.readFailures.add("too_large", 1)
+	case *proto.MsgTimeoutError:
+		m.readFailures.add("timeout", 1)
+	}
+}
+
+// write writes all of the metrics in the Prometheus text exposition format.
+// A server which wasn't created with NewServer reports zeros.
+func (m *metrics) write(out io.Writer, sessions []*Session) error {
+	if m == nil {
+		m = newMetrics()
+	}
+	w := &metricsWriter{w: out}
+
+	w.counter("sessions_accepted_total", "Tunnel sessions accepted from clients.", atomic.LoadInt64(&m.sessionsAccepted))
+	w.counter("auth_failures_total", "Tunnel sessions which failed to authenticate.", atomic.LoadInt64(&m.authFailures))
+	w.gauge("sessions", "Tunnel sessions currently registered.", int64(len(sessions)))
+	w.gauge("connections", "Public connections currently proxied.", m.active())
+
+	w.counterVec("binds_total", "Tunnels bound.", "protocol", m.binds)
+	w.counterVec("bind_failures_total", "Tunnel binds which failed.", "protocol", m.bindFailures)
+	w.counterVec("unbinds_total", "Tunnels unbound.", "protocol", m.unbinds)
+	w.counterVec("connections_opened_total", "Public connections opened.", "protocol", m.connsOpened)
+	w.counterVec("connections_closed_total", "Public connections closed.", "protocol", m.connsClosed)
+	w.counterVec("bytes_in_total", "Bytes proxied in over public connections.", "protocol", m.bytesIn)
+	w.counterVec("bytes_out_total", "Bytes proxied out over public connections.", "protocol", m.bytesOut)
+	w.counterVec("proxy_failures_total", "Failures to open a proxy stream to the client.", "protocol", m.proxyFailures)
+	w.counterVec("message_violations_total", "Control messages which were too large or too slow to arrive.", "reason", m.readFailures)
+
+	tunnels := make([]*Tunnel, 0)
+	for _, sess := range sessions {
+		tunnels = append(tunnels, sess.Tunnels()...)
+	}
+	sort.Sort(byTunnelUrl(tunnels))
+
+	w.tunnelGauge("tunnel_connections", "Public connections currently proxied by a tunnel.", tunnels, func(t *Tunnel) *int64 { return &t.conns })
+	w.tunnelCounter("tunnel_connections_opened_total", "Public connections opened on a tunnel.", tunnels, func(t *Tunnel) *int64 { return &t.connsOpened })
+	w.tunnelCounter("tunnel_connections_closed_total", "Public connections closed on a tunnel.", tunnels, func(t *Tunnel) *int64 { return &t.connsClosed })
+	w.tunnelCounter("tunnel_bytes_in_total", "Bytes proxied in over a tunnel's public connections.", tunnels, func(t *Tunnel) *int64 { return &t.bytesIn })
+	w.tunnelCounter("tunnel_bytes_out_total", "Bytes proxied out over a tunnel's public connections.", tunnels, func(t *Tunnel) *int64 { return &t.bytesOut })
+
+	return w.err
+}
+
+// metricsWriter writes metric families in the Prometheus text format,
+// remembering the first error it encounters
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *metricsWriter) printf(format string, args ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, args...)
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	w.printf("# HELP %s%s %s\n", metricsPrefix, name, help)
+	w.printf("# TYPE %s%s %s\n", metricsPrefix, name, typ)
+}
+
+func (w *metricsWriter) sample(name, labelName, labelValue string, value int64) {
+	if labelName == "" {
+		w.printf("%s%s %d\n", metricsPrefix, name, value)
+	} else {
+		w.printf("%s%s{%s=\"%s\"} %d\n", metricsPrefix, name, labelName, escapeLabel(labelValue), value)
+	}
+}
+
+func (w *metricsWriter) counter(name, help string, value int64) {
+	w.header(name, "counter", help)
+	w.sample(name, "", "", value)
+}
+
+func (w *metricsWriter) gauge(name, help string, value int64) {
+	w.header(name, "gauge", help)
+	w.sample(name, "", "", value)
+}
+
+func (w *metricsWriter) counterVec(name, help, labelName string, c *counterVec) {
+	values := c.snapshot()
+	labels := make([]string, 0, len(values))
+	for label := range values {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	w.header(name, "counter", help)
+	for _, label := range labels {
+		w.sample(name, labelName, label, values[label])
+	}
+}
+
+func (w *metricsWriter) tunnelCounter(name, help string, tunnels []*Tunnel, field func(*Tunnel) *int64) {
+	w.tunnelSamples(name, "counter", help, tunnels, field)
+}
+
+func (w *metricsWriter) tunnelGauge(name, help string, tunnels []*Tunnel, field func(*Tunnel) *int64) {
+	w.tunnelSamples(name, "gauge", help, tunnels, field)
+}
+
+func (w *metricsWriter) tunnelSamples(name, typ, help string, tunnels []*Tunnel, field func(*Tunnel) *int64) {
+	w.header(name, typ, help)
+	for _, t := range tunnels {
+		w.sample(name, "tunnel", t.url, atomic.LoadInt64(field(t)))
+	}
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// MetricsHandler returns an http.Handler which serves the server's metrics in the
+// Prometheus text exposition format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := s.WriteMetrics(w); err != nil {
+			s.Warn("Failed to write metrics: %v", err)
+		}
+	})
+}
+
+// WriteMetrics writes the server's metrics to w in the Prometheus text exposition format.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	return s.metrics.write(w, s.registry.sessions())
+}
+
+type byTunnelUrl []*Tunnel
+
+func (t byTunnelUrl) Len() int           { return len(t) }
+func (t byTunnelUrl) Less(i, j int) bool { return t[i].url < t[j].url }
+func (t byTunnelUrl) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
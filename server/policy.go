@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A Policy restricts which tunnels the clients of a server may bind depending on
+// the identity their session authenticated as (see Session.Identity). It is
+// evaluated for every bind request once the OnBind hook has accepted it.
+//
+// The first rule whose Identities match the session's identity applies. A bind
+// request which no rule applies to is denied, so a policy that should let
+// everyone else bind anything must end with a rule which has no restrictions.
+//
+// Policies are usually loaded from a YAML or JSON file with LoadPolicy:
+//
+//	rules:
+//	  - identities: [alice]
+//	    protocols: [http, https]
+//	    subdomains: [alice, "alice-*"]
+//	    requireAuth: true
+//	    maxTunnels: 3
+//	  - identities: ["ci-*"]
+//	    protocols: [tcp]
+//	    ports: ["20000-20100"]
+//	  - identities: ["*"]
+//	    protocols: [http]
+type Policy struct {
+	Rules []*PolicyRule `json:"rules" yaml:"rules"`
+
+	// synchronizes checking binds against MaxTunnels with reserving them
+	lock sync.Mutex
+
+	// number of binds which were allowed but whose tunnels aren't bound yet, by identity
+	pending map[pendingKey]int
+}
+
+// pendingKey identifies whose tunnels count against a MaxTunnels limit: those
+// of all sessions of an identity, or those of a single unauthenticated session
+type pendingKey struct {
+	name string
+	sess *Session
+}
+
+// A PolicyRule describes what the identities it applies to may bind. Empty fields
+// don't restrict anything. Identities, Hostnames and Subdomains hold patterns in
+// the syntax of path.Match.
+type PolicyRule struct {
+	// Identities are the names of the identities the rule applies to. Sessions
+	// which did not authenticate as anyone have the empty name, which is only
+	// matched by "*" or an empty list.
+	Identities []string `json:"identities" yaml:"identities"`
+
+	// Protocols are the names of the binders which may be used
+	Protocols []string `json:"protocols" yaml:"protocols"`
+
+	// Hostnames and Subdomains restrict the names of http, https and tls tunnels.
+	// If either is set, clients must ask for a hostname or subdomain matching one
+	// of them and may not bind random subdomains.
+	Hostnames  []string `json:"hostnames" yaml:"hostnames"`
+	Subdomains []string `json:"subdomains" yaml:"subdomains"`
+
+	// Ports restricts the ports of tcp tunnels to single ports like "22" or
+	// inclusive ranges like "20000-20100". If it is set, clients must ask for a
+	// specific port and may not bind random ports.
+	Ports []string `json:"ports" yaml:"ports"`
+
+	// RequireAuth requires http and https tunnels to be protected with HTTP basic auth
+	RequireAuth bool `json:"requireAuth" yaml:"requireAuth"`
+
+	// MaxTunnels limits the number of tunnels bound at once by all of the
+	// sessions of an identity. Zero means no limit.
+	MaxTunnels int `json:"maxTunnels" yaml:"maxTunnels"`
+
+	// parsed Ports
+	portRanges []portRange
+}
+
+type portRange struct {
+	min, max uint16
+}
+
+// LoadPolicy reads a policy from the file at path. Files ending in .json are
+// parsed as JSON, anything else as YAML.
+func LoadPolicy(path string) (*Policy, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(Policy)
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(bytes, p)
+	} else {
+		err = yaml.Unmarshal(bytes, p)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse policy %s: %v", path, err)
+	}
+
+	if err = p.compile(); err != nil {
+		return nil, fmt.Errorf("Invalid policy %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// compile validates the policy's rules and parses their port ranges
+func (p *Policy) compile() error {
+	for i, r := range p.Rules {
+		patterns := append(append(append([]string{}, r.Identities...), r.Hostnames...), r.Subdomains...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: bad pattern %q", i+1, pattern)
+			}
+		}
+
+		r.portRanges = make([]portRange, 0, len(r.Ports))
+		for _, ports := range r.Ports {
+			pr, err := parsePortRange(ports)
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", i+1, err)
+			}
+			r.portRanges = append(r.portRanges, pr)
+		}
+	}
+	return nil
+}
+
+func parsePortRange(s string) (pr portRange, err error) {
+	bounds := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	min, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+	if err != nil {
+		return pr, fmt.Errorf("bad port range %q", s)
+	}
+
+	max := min
+	if len(bounds) == 2 {
+		if max, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16); err != nil || max < min {
+			return pr, fmt.Errorf("bad port range %q", s)
+		}
+	}
+
+	return portRange{min: uint16(min), max: uint16(max)}, nil
+}
+
+// rule returns the rule which applies to identity, or nil if there is none
+func (p *Policy) rule(identity string) *PolicyRule {
+	for _, r := range p.Rules {
+		if len(r.Identities) == 0 || matchAny(r.Identities, identity) {
+			return r
+		}
+	}
+	return nil
+}
+
+// reserve checks whether the policy allows sess to bind a tunnel with bind and, if it
+// does, counts the tunnel against the limits of the session's identity until release
+// is called. Call release once the tunnel was added to the session or failed to bind.
+func (p *Policy) reserve(sess *Session, bind *proto.Bind) (release func(), err error) {
+	key := pendingKey{sess: sess}
+	if identity := sess.Identity(); identity != nil {
+		key = pendingKey{name: identity.Name}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err = p.check(sess, bind, p.pending[key]); err != nil {
+		return nil, err
+	}
+
+	if p.pending == nil {
+		p.pending = make(map[pendingKey]int)
+	}
+	p.pending[key]++
+
+	return func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if p.pending[key]--; p.pending[key] == 0 {
+			delete(p.pending, key)
+		}
+	}, nil
+}
+
+// check returns a descriptive error if the policy does not allow sess to bind a
+// tunnel with bind, counting pending binds of the same identity which are still in
+// progress against its limits. The caller must hold the policy's lock.
+func (p *Policy) check(sess *Session, bind *proto.Bind, pending int) error {
+	var name, who string
+	if identity := sess.Identity(); identity != nil {
+		name, who = identity.Name, "Identity "+identity.Name
+	} else {
+		who = "Unauthenticated clients"
+	}
+
+	r := p.rule(name)
+	if r == nil {
+		return fmt.Errorf("%s may not bind tunnels", who)
+	}
+
+	if len(r.Protocols) > 0 && !contains(r.Protocols, bind.Protocol) {
+		return fmt.Errorf("%s may not bind %s tunnels", who, bind.Protocol)
+	}
+
+	switch bind.Protocol {
+	case "http", "https":
+		var opts proto.HTTPOptions
+		if err := proto.UnpackInterfaceField(bind.Options, &opts); err != nil {
+			return err
+		}
+		if err := r.checkName(who, opts.Hostname, opts.Subdomain); err != nil {
+			return err
+		}
+		if r.RequireAuth && opts.Auth == "" {
+			return fmt.Errorf("%s must protect %s tunnels with HTTP basic auth", who, bind.Protocol)
+		}
+
+	case "tls":
+		var opts proto.TLSOptions
+		if err := proto.UnpackInterfaceField(bind.Options, &opts); err != nil {
+			return err
+		}
+		if err := r.checkName(who, opts.Hostname, opts.Subdomain); err != nil {
+			return err
+		}
+
+	case "tcp":
+		var opts proto.TCPOptions
+		if err := proto.UnpackInterfaceField(bind.Options, &opts); err != nil {
+			return err
+		}
+		if err := r.checkPort(who, opts.RemotePort); err != nil {
+			return err
+		}
+	}
+
+	if r.MaxTunnels > 0 && countTunnels(sess, name)+pending >= r.MaxTunnels {
+		return fmt.Errorf("%s may not bind more than %d tunnels", who, r.MaxTunnels)
+	}
+
+	return nil
+}
+
+func (r *PolicyRule) checkName(who, hostname, subdomain string) error {
+	if len(r.Hostnames) == 0 && len(r.Subdomains) == 0 {
+		return nil
+	}
+
+	// the same precedence as the binders: hostname, then subdomain, then a random name
+	hostname, subdomain = strings.ToLower(strings.TrimSpace(hostname)), strings.ToLower(strings.TrimSpace(subdomain))
+	switch {
+	case hostname != "":
+		if !matchAny(r.Hostnames, hostname) {
+			return fmt.Errorf("%s may not bind hostname %s", who, hostname)
+		}
+	case subdomain != "":
+		if !matchAny(r.Subdomains, subdomain) {
+			return fmt.Errorf("%s may not bind subdomain %s", who, subdomain)
+		}
+	default:
+		return fmt.Errorf("%s must ask for a specific hostname or subdomain", who)
+	}
+	return nil
+}
+
+func (r *PolicyRule) checkPort(who string, port uint16) error {
+	if len(r.portRanges) == 0 {
+		return nil
+	}
+
+	if port == 0 {
+		return fmt.Errorf("%s must ask for a specific port", who)
+	}
+
+	for _, pr := range r.portRanges {
+		if port >= pr.min && port <= pr.max {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not bind port %d, allowed ports are %s", who, port, strings.Join(r.Ports, ", "))
+}
+
+// countTunnels returns the number of tunnels bound by all of the sessions which
+// authenticated as the same identity as sess. Unauthenticated sessions are limited
+// individually.
+func countTunnels(sess *Session, name string) (n int) {
+	if name == "" {
+		return len(sess.Tunnels())
+	}
+
+	for _, other := range sess.registry.sessions() {
+		otherName := ""
+		if identity := other.Identity(); identity != nil {
+			otherName = identity.Name
+		}
+		if otherName == name {
+			n += len(other.Tunnels())
+		}
+	}
+	return
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
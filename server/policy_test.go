@@ -0,0 +1,231 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	proto "github.com/inconshreveable/go-tunnel/proto"
+)
+
+const testPolicy = `
+rules:
+  - identities: [alice]
+    protocols: [http, https]
+    subdomains: [alice, "alice-*"]
+    hostnames: ["*.alice.example.com"]
+    requireAuth: true
+    maxTunnels: 2
+  - identities: ["ci-*"]
+    protocols: [tcp]
+    ports: ["22", "20000-20100"]
+  - identities: ["*"]
+    protocols: [http, tls]
+    maxTunnels: 1
+`
+
+// newTestSession creates a session which authenticated as name, or not at all if
+// name is empty, and registers it with registry
+func newTestSession(registry *sessionRegistry, id, name string) *Session {
+	sess := &Session{id: id, registry: registry, tunnels: make(map[string]*Tunnel)}
+	if name != "" {
+		sess.SetIdentity(&Identity{Name: name})
+	}
+	registry.register(sess)
+	return sess
+}
+
+func addTestTunnel(sess *Session, url string) {
+	sess.tunnels[url] = &Tunnel{url: url, sess: sess}
+}
+
+func writeTestPolicy(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestPolicy(t *testing.T) *Policy {
+	p, err := LoadPolicy(writeTestPolicy(t, "policy.yml", testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		err      string
+	}{
+		{"yaml", "policy.yml", testPolicy, ""},
+		{"json", "policy.JSON", `{"rules": [{"identities": ["*"], "ports": ["1-2"]}]}`, ""},
+		{"bad yaml", "policy.yml", "rules: [", "Failed to parse policy"},
+		{"yaml as json", "policy.json", testPolicy, "Failed to parse policy"},
+		{"bad pattern", "policy.yml", "rules:\n  - identities: [\"[\"]\n", `rule 1: bad pattern "["`},
+		{"bad port", "policy.yml", "rules:\n  - {}\n  - ports: [http]\n", `rule 2: bad port range "http"`},
+		{"reversed ports", "policy.yml", "rules:\n  - ports: [\"20-10\"]\n", `bad port range "20-10"`},
+		{"port too large", "policy.yml", "rules:\n  - ports: [\"65536\"]\n", `bad port range "65536"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPolicy(writeTestPolicy(t, tt.file, tt.contents))
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("rejected valid policy: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	p := loadTestPolicy(t)
+	registry := NewSessionRegistry()
+	alice := newTestSession(registry, "alice", "alice")
+	ci := newTestSession(registry, "ci", "ci-runner")
+	bob := newTestSession(registry, "bob", "bob")
+	anonymous := newTestSession(registry, "anonymous", "")
+
+	http := func(hostname, subdomain, auth string) *proto.Bind {
+		return &proto.Bind{Protocol: "http", Options: &proto.HTTPOptions{Hostname: hostname, Subdomain: subdomain, Auth: auth}}
+	}
+	tcp := func(port uint16) *proto.Bind {
+		return &proto.Bind{Protocol: "tcp", Options: &proto.TCPOptions{RemotePort: port}}
+	}
+
+	tests := []struct {
+		name string
+		sess *Session
+		bind *proto.Bind
+		err  string
+	}{
+		{"subdomain", alice, http("", "alice", "u:p"), ""},
+		{"subdomain pattern", alice, http("", "Alice-Dev", "u:p"), ""},
+		{"hostname pattern", alice, http("www.alice.example.com", "ignored", "u:p"), ""},
+		{"other subdomain", alice, http("", "bob", "u:p"), "may not bind subdomain bob"},
+		{"other hostname", alice, http("bob.example.com", "alice", "u:p"), "may not bind hostname bob.example.com"},
+		{"random name", alice, http("", "", "u:p"), "must ask for a specific hostname or subdomain"},
+		{"no basic auth", alice, http("", "alice", ""), "must protect http tunnels"},
+		{"protocol", alice, &proto.Bind{Protocol: "tcp"}, "Identity alice may not bind tcp tunnels"},
+
+		{"port", ci, tcp(22), ""},
+		{"port range", ci, tcp(20100), ""},
+		{"port outside range", ci, tcp(20101), "may not bind port 20101, allowed ports are 22, 20000-20100"},
+		{"random port", ci, tcp(0), "must ask for a specific port"},
+
+		{"fallback rule", bob, http("", "", ""), ""},
+		{"fallback protocol", bob, &proto.Bind{Protocol: "https"}, "may not bind https tunnels"},
+		{"unauthenticated", anonymous, &proto.Bind{Protocol: "tls", Options: &proto.TLSOptions{Subdomain: "x"}}, ""},
+		{"unauthenticated protocol", anonymous, &proto.Bind{Protocol: "tcp"}, "Unauthenticated clients may not bind tcp tunnels"},
+		{"bad options", bob, &proto.Bind{Protocol: "http", Options: proto.RawValue(`"x"`)}, "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.check(tt.sess, tt.bind, 0)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("denied allowed bind: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPolicyWithoutMatchingRule(t *testing.T) {
+	p := &Policy{Rules: []*PolicyRule{{Identities: []string{"alice"}}}}
+	if err := p.compile(); err != nil {
+		t.Fatal(err)
+	}
+	registry := NewSessionRegistry()
+
+	if err := p.check(newTestSession(registry, "1", "bob"), &proto.Bind{Protocol: "http"}, 0); err == nil {
+		t.Error("allowed a bind no rule applies to")
+	}
+	if err := p.check(newTestSession(registry, "2", ""), &proto.Bind{Protocol: "http"}, 0); err == nil {
+		t.Error("allowed an unauthenticated bind no rule applies to")
+	}
+	if err := p.check(newTestSession(registry, "3", "alice"), &proto.Bind{Protocol: "http"}, 0); err != nil {
+		t.Errorf("denied a bind of an unrestricted rule: %v", err)
+	}
+}
+
+func TestPolicyMaxTunnels(t *testing.T) {
+	p := loadTestPolicy(t)
+	registry := NewSessionRegistry()
+	bind := &proto.Bind{Protocol: "http", Options: &proto.HTTPOptions{Subdomain: "alice", Auth: "u:p"}}
+
+	// the tunnels of all of an identity's sessions count against its limit
+	first := newTestSession(registry, "first", "alice")
+	second := newTestSession(registry, "second", "alice")
+	addTestTunnel(first, "http://alice.example.com")
+
+	release, err := p.reserve(second, bind)
+	if err != nil {
+		t.Fatalf("denied the second tunnel: %v", err)
+	}
+	if _, err = p.reserve(first, bind); err == nil || !strings.Contains(err.Error(), "may not bind more than 2 tunnels") {
+		t.Fatalf("got error %v for a third tunnel while the second is pending, want the limit", err)
+	}
+
+	// a bind which failed gives its place back
+	release()
+	release2, err := p.reserve(first, bind)
+	if err != nil {
+		t.Fatalf("denied a tunnel after a pending one was released: %v", err)
+	}
+
+	// a bind which succeeded counts as a tunnel of its session instead
+	addTestTunnel(first, "http://alice-2.example.com")
+	release2()
+	if _, err = p.reserve(second, bind); err == nil {
+		t.Fatal("allowed a third bound tunnel")
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("%d pending binds left after releasing all of them", len(p.pending))
+	}
+
+	// other identities aren't affected
+	if _, err = p.reserve(newTestSession(registry, "bob", "bob"), &proto.Bind{Protocol: "http"}); err != nil {
+		t.Errorf("denied another identity's tunnel: %v", err)
+	}
+}
+
+func TestPolicyMaxTunnelsUnauthenticated(t *testing.T) {
+	p := loadTestPolicy(t)
+	registry := NewSessionRegistry()
+	bind := &proto.Bind{Protocol: "http"}
+
+	// unauthenticated sessions are limited individually
+	first := newTestSession(registry, "first", "")
+	second := newTestSession(registry, "second", "")
+
+	release, err := p.reserve(first, bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	if _, err = p.reserve(first, bind); err == nil {
+		t.Error("allowed a second pending tunnel of the same session")
+	}
+	if _, err = p.reserve(second, bind); err != nil {
+		t.Errorf("denied another unauthenticated session's tunnel: %v", err)
+	}
+}
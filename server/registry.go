@@ -2,6 +2,8 @@ package server
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // keeps a mapping from session id -> session
@@ -10,6 +12,12 @@ import (
 type sessionRegistry struct {
 	sync.Mutex
 	registry map[string]*Session
+
+	// how long the tunnels of a disconnected session are kept bound for it to resume
+	gracePeriod time.Duration
+
+	// how many public connections each tunnel queues while its session is disconnected
+	graceQueueSize int
 }
 
 func NewSessionRegistry() *sessionRegistry {
@@ -22,12 +30,17 @@ func (s *sessionRegistry) register(sess *Session) {
 	s.Lock()
 	old, ok := s.registry[sess.id]
 	if ok {
-		defer func() {
-			// make sure the old session instance doesn't remove the new one
-			// when it shuts down
-			old.id = ""
-			old.Shutdown()
-		}()
+		// hand the tunnels of the old instance over to the new one
+		// so that they survive the reconnect
+		if s.gracePeriod > 0 {
+			old.handoff(sess)
+			time.AfterFunc(s.gracePeriod, sess.releaseResumed)
+		}
+
+		// make sure the old session instance doesn't remove the new one
+		// when it shuts down
+		old.id = ""
+		defer old.Shutdown()
 	}
 
 	s.registry[sess.id] = sess
@@ -37,7 +50,60 @@ func (s *sessionRegistry) register(sess *Session) {
 func (s *sessionRegistry) unregister(sess *Session) error {
 	s.Lock()
 	defer s.Unlock()
-	delete(s.registry, sess.id)
+	if s.registry[sess.id] == sess {
+		delete(s.registry, sess.id)
+	}
 
 	return nil
 }
+
+// park keeps the tunnels of a session whose client has disconnected bound
+// for the grace period so that the client may resume them. It returns false
+// if the session should be shut down instead.
+func (s *sessionRegistry) park(sess *Session) bool {
+	if s.gracePeriod <= 0 {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.registry[sess.id] != sess || atomic.LoadInt32(&sess.closing) == 1 {
+		return false
+	}
+
+	sess.Info("Client disconnected, keeping tunnels bound for %v", s.gracePeriod)
+	for _, t := range sess.Tunnels() {
+		t.park(s.graceQueueSize)
+	}
+	sess.parkTimer = time.AfterFunc(s.gracePeriod, func() { s.expire(sess) })
+	return true
+}
+
+// expire shuts down a parked session which was not resumed during the grace period
+func (s *sessionRegistry) expire(sess *Session) {
+	s.Lock()
+	current := s.registry[sess.id] == sess
+	s.Unlock()
+
+	if current {
+		sess.Info("Grace period expired before the client reconnected")
+		sess.Shutdown()
+	}
+}
+
+func (s *sessionRegistry) get(id string) (sess *Session, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	sess, ok = s.registry[id]
+	return
+}
+
+func (s *sessionRegistry) sessions() []*Session {
+	s.Lock()
+	defer s.Unlock()
+	sessions := make([]*Session, 0, len(s.registry))
+	for _, sess := range s.registry {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
@@ -1,15 +1,36 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	log "github.com/inconshreveable/go-tunnel/log"
+	proto "github.com/inconshreveable/go-tunnel/proto"
 	"github.com/inconshreveable/go-tunnel/server/binder"
 	muxado "github.com/inconshreveable/muxado"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Binders map[string]binder.Binder
 
+// ErrServerClosed is returned by Server.Run after a call to Shutdown or Close
+var ErrServerClosed = errors.New("Server closed")
+
+const (
+	// how often Shutdown checks whether all proxied connections have finished
+	shutdownPollInterval = 500 * time.Millisecond
+
+	// longest time to wait before retrying after a temporary accept error
+	maxAcceptDelay = time.Second
+
+	// default for Server.ReadTimeout
+	defaultReadTimeout = 30 * time.Second
+)
+
 // A Server accepts new go-tunnel connections from clients and establishes
 // a Session on which it wil services their requests to listen for
 // connections on the Server's ports and/or hostnames of well-known protocols.
@@ -18,11 +39,57 @@ type Binders map[string]binder.Binder
 // and TunnelHooks properties before calling .Run()
 type Server struct {
 	log.Logger                    // logger for the server object
-	listener     *muxado.Listener // listener for new sessions
 	registry     *sessionRegistry // map of session id -> Session
 	Binders                       // a map of protocol name -> tunnel binder
 	SessionHooks                  // user-defined hooks to customize session behavior
 	TunnelHooks                   // user-definied hooks to customize tunnel behavior
+	metrics      *metrics         // counters exposed by MetricsHandler
+
+	// MaxMsgSize is the largest control message accepted from clients.
+	// Zero means proto.DefaultMaxMsgSize.
+	MaxMsgSize int64
+
+	// ReadTimeout is how long a client has to authenticate a new session and to
+	// send a control message after opening a stream. Zero means no timeout.
+	ReadTimeout time.Duration
+
+	// GracePeriod is how long the tunnels of a session whose client disconnected
+	// stay bound so that the client can resume them by reconnecting with the same
+	// ClientId. Zero disables resumption: tunnels are shut down with their session.
+	GracePeriod time.Duration
+
+	// GraceQueueSize is how many public connections each tunnel holds while its
+	// session is disconnected. They are proxied once the client reconnects.
+	// Connections beyond the limit are closed immediately.
+	GraceQueueSize int
+
+	// Policy, if set, restricts the tunnels clients may bind depending on who they
+	// authenticated as. See LoadPolicy.
+	Policy *Policy
+
+	// HeartbeatInterval is how often the server pings each client to detect connections
+	// which died silently, e.g. because a NAT mapping expired. Zero disables heartbeats,
+	// which older clients don't support.
+	HeartbeatInterval time.Duration
+
+	// HeartbeatTimeout is how long a client has to answer a heartbeat before the server
+	// closes its connection. Zero means HeartbeatInterval.
+	HeartbeatTimeout time.Duration
+
+	// GoAway is sent to every client when Shutdown begins to tell them why their
+	// sessions are about to end and when and where to reconnect. Defaults to a
+	// GoAway with the reason "Server is shutting down".
+	GoAway *proto.GoAway
+
+	listenersLock sync.Mutex     // protects listeners and running
+	listeners     []net.Listener // listeners for new sessions
+	running       bool           // set once Run accepts sessions from the listeners
+	acceptErr     chan error     // the first permanent error from a listener
+	closed        chan struct{}  // closed once Shutdown or Close is called
+
+	sessionsLock sync.Mutex        // protects sessions
+	sessions     map[*Session]bool // every running session, authenticated or not
+	closing      int32             // set once Shutdown or Close is called
 }
 
 // Serve creates a Server listening for new connections on the given address.
@@ -48,30 +115,303 @@ func ServeTLS(network, addr string, tlsConfig *tls.Config, binders Binders) (*Se
 }
 
 // NewServer creates a new server which binds tunnels with binders on sessions
-// it accepts from the given listener.
+// it accepts from the given listener. listener may be nil if the server only
+// accepts sessions from listeners added with AddListener or from its WebSocketHandler.
 func NewServer(listener net.Listener, binders Binders) *Server {
-	return &Server{
-		Logger:       log.NewTaggedLogger("server", listener.Addr().String()),
-		listener:     muxado.NewListener(listener),
+	tags := []string{"server"}
+	if listener != nil {
+		tags = append(tags, listener.Addr().String())
+	}
+
+	s := &Server{
+		Logger:       log.NewTaggedLogger(tags...),
 		registry:     NewSessionRegistry(),
 		Binders:      binders,
 		TunnelHooks:  new(NoopTunnelHooks),
 		SessionHooks: new(NoopSessionHooks),
+		metrics:      newMetrics(),
+		sessions:     make(map[*Session]bool),
+		MaxMsgSize:   proto.DefaultMaxMsgSize,
+		ReadTimeout:  defaultReadTimeout,
+		acceptErr:    make(chan error, 1),
+		closed:       make(chan struct{}),
+	}
+
+	if listener != nil {
+		s.listeners = append(s.listeners, listener)
 	}
+	return s
 }
 
-// Run loops forever accepting new tunnel sessions from remote clients
+// AddListener makes the server accept sessions from another listener as well, e.g. to
+// serve clients over both plain TCP and TLS. Sessions from every listener share the same
+// binders, hooks and registry, so a client may resume its session over any of them.
+// Listeners may be added before or while Run is running.
+func (s *Server) AddListener(listener net.Listener) error {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	if atomic.LoadInt32(&s.closing) == 1 {
+		return ErrServerClosed
+	}
+
+	s.listeners = append(s.listeners, listener)
+	if s.running {
+		go s.accept(listener)
+	}
+	return nil
+}
+
+// Run loops accepting new tunnel sessions from remote clients on every listener until
+// the server is shut down, in which case it returns ErrServerClosed, or one of the
+// listeners fails permanently, in which case the other listeners keep accepting sessions.
 func (s *Server) Run() error {
-	s.Info("Listening for tunnel sessions on %s", s.listener.Addr().String())
+	if s.Policy != nil {
+		if err := s.Policy.compile(); err != nil {
+			return s.Error("Invalid policy: %v", err)
+		}
+	}
+
+	s.registry.Lock()
+	s.registry.gracePeriod, s.registry.graceQueueSize = s.GracePeriod, s.GraceQueueSize
+	s.registry.Unlock()
+
+	s.listenersLock.Lock()
+	s.running = true
+	for _, l := range s.listeners {
+		go s.accept(l)
+	}
+	s.listenersLock.Unlock()
 
+	select {
+	case err := <-s.acceptErr:
+		return err
+	case <-s.closed:
+		return ErrServerClosed
+	}
+}
+
+// accept loops accepting new tunnel sessions from a listener until it fails permanently
+func (s *Server) accept(l net.Listener) {
+	s.Info("Listening for tunnel sessions on %s", l.Addr().String())
+
+	var delay time.Duration
 	for {
-		sess, err := s.listener.Accept()
+		c, err := l.Accept()
 		if err != nil {
-			s.Error("Failed to accept new tunnel session: %v", err)
-			continue
+			if atomic.LoadInt32(&s.closing) == 1 {
+				return
+			}
+
+			// back off on temporary errors like running out of file descriptors
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay = 2 * delay
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				s.Error("Failed to accept new tunnel session: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			err = s.Error("Failed to accept new tunnel session on %s: %v", l.Addr().String(), err)
+			select {
+			case s.acceptErr <- err:
+			default:
+			}
+			return
+		}
+		delay = 0
+
+		go s.serveConn(c)
+	}
+}
+
+// serveConn runs a tunnel session on a connection accepted from one of the listeners
+func (s *Server) serveConn(c net.Conn) {
+	var state *tls.ConnectionState
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		// complete the handshake up front so that the client's certificate
+		// is known by the time it authenticates
+		if s.ReadTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			s.Warn("Failed TLS handshake with %v: %v", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		connState := tlsConn.ConnectionState()
+		state = &connState
+	}
+
+	s.runSession(s.newSession(muxado.Server(c), state))
+}
+
+// newSession starts tracking a tunnel session accepted from a client. state
+// describes the client's TLS connection, if it connected over TLS.
+func (s *Server) newSession(mux muxado.Session, state *tls.ConnectionState) *Session {
+	s.Info("New tunnel session from: %v", mux.RemoteAddr())
+	s.metrics.sessionAccepted()
+
+	session := newServerSession(mux, s)
+	session.peerCert = peerCertificate(state)
+	s.addSession(session)
+	return session
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new sessions, stops every
+// session from binding new tunnels and closes the public listeners of all bound tunnels.
+// It then waits for the connections which are already being proxied to finish before it
+// closes every session and every binder which implements io.Closer. Clients will see their
+// sessions close at that point and a ReconnectingSession will redial.
+//
+// If ctx expires before the proxied connections finish, the remaining sessions are closed
+// anyway and Shutdown returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return ErrServerClosed
+	}
+	s.Info("Shutting down, draining %d proxied connections", s.metrics.active())
+
+	// stop accepting new sessions
+	s.closeListeners()
+
+	// warn the clients before their sessions end
+	s.goAway()
+
+	// stop accepting new public connections
+	for _, sess := range s.allSessions() {
+		sess.drain()
+	}
+
+	// wait for in-flight connections to finish
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.metrics.active() > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			s.Warn("Shutdown deadline exceeded, dropping %d proxied connections", s.metrics.active())
+		case <-ticker.C:
+		}
+	}
+
+	s.closeAll()
+	return
+}
+
+// goAway sends the server's GoAway message to the client of every live session
+func (s *Server) goAway() {
+	msg := s.GoAway
+	if msg == nil {
+		msg = &proto.GoAway{Reason: "Server is shutting down"}
+	}
+
+	var wait sync.WaitGroup
+	for _, sess := range s.liveSessions() {
+		wait.Add(1)
+		go func(sess *Session) {
+			defer wait.Done()
+			if err := sess.GoAway(msg); err != nil {
+				sess.Debug("Failed to send GoAway: %v", err)
+			}
+		}(sess)
+	}
+	wait.Wait()
+}
+
+// allSessions returns the running sessions as well as the disconnected
+// sessions kept in the registry during their grace period
+func (s *Server) allSessions() []*Session {
+	sessions := s.liveSessions()
+	for _, sess := range s.registry.sessions() {
+		if !s.isLive(sess) {
+			sessions = append(sessions, sess)
 		}
-		s.Info("New tunnel session from: %v", sess.RemoteAddr())
+	}
+	return sessions
+}
+
+// Close immediately shuts down the server, closing every session and every binder
+// which implements io.Closer without waiting for proxied connections to finish.
+func (s *Server) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return ErrServerClosed
+	}
+	s.Info("Closing")
+
+	err := s.closeListeners()
+	s.closeAll()
+	return err
+}
+
+// closeListeners stops accepting new sessions from every listener
+func (s *Server) closeListeners() (err error) {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	for _, l := range s.listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	close(s.closed)
+	return
+}
+
+func (s *Server) closeAll() {
+	for _, sess := range s.allSessions() {
+		sess.Shutdown()
+	}
+
+	for name, b := range s.Binders {
+		if c, ok := b.(io.Closer); ok {
+			// binders may share a listener, so failures here are expected
+			if err := c.Close(); err != nil {
+				s.Debug("Failed to close %s binder: %v", name, err)
+			}
+		}
+	}
+
+	s.Info("Shutdown complete")
+}
+
+func (s *Server) runSession(sess *Session) {
+	defer s.delSession(sess)
+	sess.Run()
+}
+
+func (s *Server) addSession(sess *Session) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	s.sessions[sess] = true
+}
+
+func (s *Server) delSession(sess *Session) {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	delete(s.sessions, sess)
+}
+
+func (s *Server) isLive(sess *Session) bool {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	return s.sessions[sess]
+}
 
-		go NewSession(sess, s.registry, s.SessionHooks, s.TunnelHooks, s.Binders).Run()
+func (s *Server) liveSessions() []*Session {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
 	}
+	return sessions
 }
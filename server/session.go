@@ -1,19 +1,30 @@
 package server
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	conn "github.com/inconshreveable/go-tunnel/conn"
 	log "github.com/inconshreveable/go-tunnel/log"
 	proto "github.com/inconshreveable/go-tunnel/proto"
 	util "github.com/inconshreveable/go-tunnel/util"
 	muxado "github.com/inconshreveable/muxado"
+	"net"
 	"reflect"
 	"runtime/debug"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// how long the server waits to deliver a message it sends on its own initiative
+	sendTimeout = 10 * time.Second
+)
+
+// errNoServerPush is returned when sending a message to a client which doesn't expect any
+var errNoServerPush = errors.New("Client does not support messages sent by the server")
+
 type Session struct {
 	// logger
 	log.Logger
@@ -21,6 +32,12 @@ type Session struct {
 	// auth message
 	auth *proto.Auth
 
+	// optional protocol features both the client and the server support
+	capabilities proto.Capabilities
+
+	// encodes the messages following the auth response
+	codec proto.Codec
+
 	// session start time
 	start time.Time
 
@@ -30,9 +47,25 @@ type Session struct {
 	// all of the tunnels this session handles
 	tunnels map[string]*Tunnel
 
+	// tunnels handed over from a previous instance of the session which
+	// the client has not yet bound again
+	resumed map[string]*Tunnel
+
+	// fires when a disconnected session's grace period is over
+	parkTimer *time.Timer
+
 	// identifier
 	id string
 
+	// secret the client must present to resume the session after reconnecting
+	resumeToken string
+
+	// who the session authenticated as, if anyone
+	identity *Identity
+
+	// the verified certificate the client connected with, if any
+	peerCert *PeerCertificate
+
 	// session hooks
 	hooks SessionHooks
 
@@ -50,8 +83,43 @@ type Session struct {
 
 	// registry
 	registry *sessionRegistry
+
+	// set once the session begins shutting down
+	closing int32
+
+	// set once the session stops binding new tunnels because the server is shutting down
+	draining int32
+
+	// server metrics
+	metrics *metrics
+
+	// reads control messages from the client within the server's limits
+	reader *proto.MsgReader
+
+	// how long the client has to authenticate
+	authTimeout time.Duration
+
+	// restricts the tunnels the session may bind, may be nil
+	policy *Policy
+
+	// how often to ping the client and how long it has to answer, see Server.HeartbeatInterval
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	// round trip time of the latest heartbeat, in nanoseconds
+	latency int64
 }
 
+// An Identity describes who a session authenticated as. It is set by the
+// OnAuth hook, typically by one of the providers in the auth package.
+type Identity struct {
+	Name   string                 // unique name of the authenticated principal, e.g. a user id
+	Claims map[string]interface{} // provider-specific attributes of the principal
+}
+
+// SessionHooks are called as a session authenticates, binds tunnels and closes. The
+// Extra and Options of the messages they are given are already decoded into the types
+// registered with proto.RegisterExtra and proto.RegisterOptions.
 type SessionHooks interface {
 	OnAuth(*Session, *proto.Auth) error
 	OnBind(*Session, *proto.Bind) error
@@ -59,15 +127,35 @@ type SessionHooks interface {
 }
 
 func NewSession(mux muxado.Session, registry *sessionRegistry, sessHooks SessionHooks, tunnelHooks TunnelHooks, binders Binders) *Session {
+	return newServerSession(mux, &Server{
+		registry:     registry,
+		SessionHooks: sessHooks,
+		TunnelHooks:  tunnelHooks,
+		Binders:      binders,
+	})
+}
+
+// newServerSession creates a session for a client connected over mux which
+// binds tunnels with the binders, hooks and settings of the given server
+func newServerSession(mux muxado.Session, server *Server) *Session {
 	return &Session{
 		start:       time.Now(),
 		Logger:      log.NewTaggedLogger("session"),
 		mux:         mux,
 		tunnels:     make(map[string]*Tunnel, 0),
-		registry:    registry,
-		hooks:       sessHooks,
-		binders:     binders,
-		tunnelHooks: tunnelHooks,
+		resumed:     make(map[string]*Tunnel, 0),
+		registry:    server.registry,
+		hooks:       server.SessionHooks,
+		binders:     server.Binders,
+		tunnelHooks: server.TunnelHooks,
+		metrics:     server.metrics,
+		reader:      &proto.MsgReader{MaxSize: server.MaxMsgSize, Timeout: server.ReadTimeout},
+		codec:       proto.JSON,
+		authTimeout: server.ReadTimeout,
+		policy:      server.Policy,
+
+		heartbeatInterval: server.HeartbeatInterval,
+		heartbeatTimeout:  server.HeartbeatTimeout,
 	}
 }
 
@@ -88,11 +176,19 @@ func (s *Session) Run() (err error) {
 		return
 	}
 
+	// clients which can't answer pings would be disconnected
+	if s.heartbeatInterval > 0 && s.capabilities.Has(proto.CapHeartbeat) {
+		go s.heartbeat()
+	}
+
 	// then we handle new streams sent from the client
 	for {
 		stream, err := s.mux.Accept()
 		if err != nil {
-			s.Shutdown()
+			// give the client a chance to reconnect before tearing down its tunnels
+			if !s.registry.park(s) {
+				s.Shutdown()
+			}
 			return s.Error("Failed to accept stream: %v", err)
 		}
 
@@ -101,6 +197,15 @@ func (s *Session) Run() (err error) {
 }
 
 func (s *Session) handleAuth() error {
+	// don't let clients hold a session open without ever authenticating
+	if s.authTimeout > 0 {
+		timer := time.AfterFunc(s.authTimeout, func() {
+			s.Warn("Client failed to authenticate within %v", s.authTimeout)
+			s.mux.Close()
+		})
+		defer timer.Stop()
+	}
+
 	// accept ann auth stream
 	raw, err := s.mux.Accept()
 	if err != nil {
@@ -111,34 +216,56 @@ func (s *Session) handleAuth() error {
 	stream := conn.Wrap(raw, "session", "auth")
 
 	// read the Auth message
-	if err = proto.ReadMsgInto(stream, &s.auth); err != nil {
+	if err = s.reader.ReadMsgInto(stream, &s.auth); err != nil {
+		s.metrics.readFailed(err)
 		return s.Error("Failed to read auth message; %v", err)
 	}
 
 	failAuth := func(e error) error {
+		s.metrics.authFailed()
 		_ = proto.WriteMsg(stream, &proto.AuthResp{Error: e.Error()})
 		return e
 	}
 
-	// generate a client identifier
-	s.id = s.auth.ClientId
+	// the client id is not a secret, so only let a client resume an existing
+	// session if it also knows the session's resume token
+	var old *Session
+	if s.auth.ClientId != "" {
+		var ok bool
+		if old, ok = s.registry.get(s.auth.ClientId); ok {
+			if subtle.ConstantTimeCompare([]byte(old.resumeToken), []byte(s.auth.ResumeToken)) != 1 {
+				s.Warn("Rejecting attempt to resume session %s with an invalid resume token", s.auth.ClientId)
+				return failAuth(fmt.Errorf("Invalid resume token for session %s", s.auth.ClientId))
+			}
+			s.id, s.resumeToken = s.auth.ClientId, old.resumeToken
+		} else {
+			s.Info("Session %s is gone, starting a new session", s.auth.ClientId)
+		}
+	}
+
 	if s.id == "" {
-		// it's a new session, assign an ID
+		// it's a new session, assign an ID and resume token
 		if s.id, err = util.SecureRandId(16); err != nil {
 			return failAuth(fmt.Errorf("Failed generate client identifier: %v", err))
 		}
+		if s.resumeToken, err = util.SecureRandId(32); err != nil {
+			return failAuth(fmt.Errorf("Failed generate resume token: %v", err))
+		}
 	}
 
-	// put ourselves in the registry
-	s.registry.register(s)
-
 	// set logging prefix
 	s.Logger.AddTags(s.id)
 
-	// agree on protocol version
-	// if proto.Version not in s.auth.Version
-	if sort.SearchStrings(s.auth.Version, proto.Version) == len(s.auth.Version) {
-		return failAuth(fmt.Errorf("No acceptable protocol version. Requested: %v, capable: %v", s.auth.Version, proto.Version))
+	// agree on protocol version and optional features
+	version, ok := proto.ChooseVersion(s.auth.Version)
+	if !ok {
+		return failAuth(fmt.Errorf("No acceptable protocol version. Requested: %v, capable: %v", s.auth.Version, proto.Versions))
+	}
+	s.capabilities = proto.Supported.Intersect(s.auth.Capabilities)
+
+	// hand the hooks the extra in its registered type, if it has one
+	if s.auth.Extra, err = proto.DecodeExtra(proto.AuthExtra, s.auth.Extra); err != nil {
+		return failAuth(fmt.Errorf("Invalid auth extra: %v", err))
 	}
 
 	// auth hook
@@ -146,10 +273,27 @@ func (s *Session) handleAuth() error {
 		return failAuth(err)
 	}
 
+	// a resumed session must authenticate as the same principal as the one it replaces
+	if old != nil && old.Identity() != nil {
+		if cur := s.Identity(); cur == nil || cur.Name != old.Identity().Name {
+			return failAuth(fmt.Errorf("Session %s belongs to a different identity", s.id))
+		}
+	}
+
+	// everything after the auth response uses the negotiated codec. Set it before
+	// registering, which hands us the tunnels of the session we're resuming.
+	s.codec = proto.NegotiatedCodec(s.capabilities)
+	s.reader.Codec = s.codec
+
+	// put ourselves in the registry
+	s.registry.register(s)
+
 	// Respond to authentication
 	authResp := &proto.AuthResp{
-		Version:  proto.Version,
-		ClientId: s.id,
+		Version:      version,
+		ClientId:     s.id,
+		ResumeToken:  s.resumeToken,
+		Capabilities: s.capabilities,
 	}
 
 	if err = proto.WriteMsg(stream, authResp); err != nil {
@@ -170,9 +314,10 @@ func (s *Session) handleStream(stream conn.Conn) {
 	}
 	defer s.guard.Exit()
 
-	raw, err := proto.ReadMsg(stream)
+	raw, err := s.reader.ReadMsg(stream)
 	if err != nil {
-		stream.Error("Failed to read message: %v")
+		s.metrics.readFailed(err)
+		stream.Error("Failed to read message: %v", err)
 		go s.Shutdown()
 		return
 	}
@@ -182,6 +327,10 @@ func (s *Session) handleStream(stream conn.Conn) {
 		err = s.handleBind(stream, msg)
 	case *proto.Unbind:
 		err = s.handleUnbind(stream, msg)
+	case *proto.Ping:
+		if err = proto.WriteMsgCodec(stream, s.codec, &proto.Pong{}); err != nil {
+			err = fmt.Errorf("Failed to answer heartbeat: %v", err)
+		}
 	default:
 		err = fmt.Errorf("Unknown message type: %v", reflect.TypeOf(raw))
 	}
@@ -199,54 +348,289 @@ func (s *Session) handleBind(stream conn.Conn, bind *proto.Bind) (err error) {
 	stream.Debug("Binding new tunnel: %v", bind)
 
 	respond := func(resp *proto.BindResp) {
-		if err = proto.WriteMsg(stream, resp); err != nil {
+		if err = proto.WriteMsgCodec(stream, s.codec, resp); err != nil {
 			err = stream.Error("Failed to send bind response: %v", err)
 		}
 	}
 
+	if atomic.LoadInt32(&s.draining) == 1 {
+		respond(&proto.BindResp{Error: "Server is shutting down"})
+		return
+	}
+
+	// the hooks, the policy and the binder get the options and extra in their
+	// registered types, so invalid ones are rejected before reaching any of them
+	if err = proto.DecodeBind(bind); err != nil {
+		s.metrics.bindFailed(bind.Protocol)
+		respond(&proto.BindResp{Error: err.Error()})
+		return
+	}
+
 	if err = s.hooks.OnBind(s, bind); err != nil {
 		return
 	}
 
-	t, err := newTunnel(bind, s, s.binders, s.tunnelHooks)
+	// the tunnel may have been kept bound for us while we reconnected
+	if bind.ResumeUrl != "" {
+		if t, ok := s.claimResumed(bind.ResumeUrl, bind.Protocol); ok {
+			t.Info("Resumed tunnel on session %s", s.id)
+			respond(&proto.BindResp{Url: t.url})
+			return
+		}
+	}
+
+	t, err := s.bindTunnel(bind)
 	if err != nil {
+		s.metrics.bindFailed(bind.Protocol)
 		respond(&proto.BindResp{Error: err.Error()})
 		return
 	}
+	s.metrics.bound(bind.Protocol)
 	t.Info("Registered new tunnel on session %s", s.id)
 
-	// add it to the list of tunnels
-	s.addTunnel(t)
-
 	// acknowledge success
 	respond(&proto.BindResp{Url: t.url})
 	return
 }
 
+// bindTunnel binds a new tunnel for bind if the server's policy allows it
+// and adds it to the list of tunnels
+func (s *Session) bindTunnel(bind *proto.Bind) (*Tunnel, error) {
+	if s.policy != nil {
+		release, err := s.policy.reserve(s, bind)
+		if err != nil {
+			s.Warn("Policy denied bind: %v", err)
+			return nil, err
+		}
+
+		// the reservation counts the tunnel against its identity's limits until it is added
+		defer release()
+	}
+
+	t, err := newTunnel(bind, s, s.binders, s.tunnelHooks)
+	if err != nil {
+		return nil, err
+	}
+
+	s.addTunnel(t)
+	return t, nil
+}
+
 func (s *Session) handleUnbind(stream conn.Conn, unbind *proto.Unbind) (err error) {
 	s.Debug("Unbinding tunnel")
 
-	// remote it from the list of tunnels
-	t, ok := s.delTunnel(unbind.Url)
-	if !ok {
-		return s.Error("Failed to unbind tunnel %s: no tunnel found.", unbind.Url)
+	if unbind.Extra, err = proto.DecodeExtra(proto.UnbindExtra, unbind.Extra); err != nil {
+		if err = proto.WriteMsgCodec(stream, s.codec, &proto.UnbindResp{Error: fmt.Sprintf("Invalid unbind extra: %v", err)}); err != nil {
+			return s.Error("Failed to write unbind resp: %v", err)
+		}
+		return
 	}
 
-	if err = t.shutdown(); err != nil {
+	if err = s.Unbind(unbind.Url); err != nil {
 		return s.Error("Failed to unbind tunnel %s: %v", unbind.Url, err)
 	}
 
 	// acknowledge success
 	unbindResp := &proto.UnbindResp{}
-	if err = proto.WriteMsg(stream, unbindResp); err != nil {
+	if err = proto.WriteMsgCodec(stream, s.codec, unbindResp); err != nil {
 		return s.Error("Failed to write unbind resp: %v", err)
 	}
 
 	return
 }
 
+// Unbind shuts down the tunnel bound at url and removes it from the session.
+func (s *Session) Unbind(url string) error {
+	// remove it from the list of tunnels
+	t, ok := s.delTunnel(url)
+	if !ok {
+		return fmt.Errorf("No tunnel found")
+	}
+
+	return t.shutdown()
+}
+
+// CloseTunnel unbinds the tunnel bound at url like Unbind and, if the client is
+// connected and supports it, tells it why so that it closes its side of the tunnel
+// as well and doesn't bind it again after reconnecting.
+func (s *Session) CloseTunnel(url, reason string) error {
+	if err := s.Unbind(url); err != nil {
+		return err
+	}
+
+	if err := s.send(&proto.TunnelClosed{Url: url, Reason: reason}); err != nil && err != errNoServerPush {
+		s.Warn("Failed to tell the client tunnel %s was closed: %v", url, err)
+	}
+	return nil
+}
+
+// GoAway tells the client that the session is about to be closed, why, and when
+// and where it should reconnect. Clients which don't support messages sent by the
+// server aren't told.
+func (s *Session) GoAway(msg *proto.GoAway) error {
+	return s.send(msg)
+}
+
+// Notify sends a notice to the client which doesn't end the session, e.g. to warn
+// it that it is about to exceed a quota.
+func (s *Session) Notify(notice *proto.Notice) error {
+	return s.send(notice)
+}
+
+// heartbeat pings the client every heartbeatInterval and closes the session's
+// connection once the client fails to answer within heartbeatTimeout
+func (s *Session) heartbeat() {
+	defer s.recoverPanic("Session.heartbeat")
+
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rtt, err := s.ping()
+		if err != nil {
+			if atomic.LoadInt32(&s.closing) == 0 {
+				s.Warn("Client missed heartbeat, closing the connection: %v", err)
+			}
+			s.mux.Close()
+			return
+		}
+		atomic.StoreInt64(&s.latency, int64(rtt))
+
+		if hooks, ok := s.hooks.(HeartbeatHooks); ok {
+			if err = hooks.OnHeartbeat(s, rtt); err != nil {
+				s.Warn("OnHeartbeat hook failed, closing the connection: %v", err)
+				s.mux.Close()
+				return
+			}
+		}
+	}
+}
+
+// ping sends a Ping to the client and returns how long it took to answer
+func (s *Session) ping() (time.Duration, error) {
+	timeout := s.heartbeatTimeout
+	if timeout <= 0 {
+		timeout = s.heartbeatInterval
+	}
+
+	stream, err := s.mux.Open()
+	if err != nil {
+		return 0, err
+	}
+	c := conn.Wrap(stream, "heartbeat", s.id)
+	defer c.Close()
+
+	start := time.Now()
+	if err = c.SetDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	if err = proto.WriteMsgCodec(c, s.codec, &proto.Ping{}); err != nil {
+		return 0, err
+	}
+
+	var pong proto.Pong
+	reader := proto.MsgReader{Codec: s.codec}
+	if err = reader.ReadMsgInto(c, &pong); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// send delivers a message to the client over a new stream, if the client supports it
+func (s *Session) send(msg interface{}) error {
+	if !s.capabilities.Has(proto.CapServerPush) {
+		return errNoServerPush
+	}
+
+	stream, err := s.mux.Open()
+	if err != nil {
+		return err
+	}
+	c := conn.Wrap(stream, "notify", s.id)
+	defer c.Close()
+
+	if err = c.SetWriteDeadline(time.Now().Add(sendTimeout)); err != nil {
+		return err
+	}
+	return proto.WriteMsgCodec(c, s.codec, msg)
+}
+
+// handoff moves the tunnels of a session over to the new instance of the session
+// which is replacing it after the client reconnected. The new instance has to claim
+// them when the client binds them again, so parked tunnels stay parked until then.
+func (s *Session) handoff(to *Session) {
+	if s.parkTimer != nil {
+		s.parkTimer.Stop()
+	}
+
+	s.Lock()
+	tunnels := s.tunnels
+	s.tunnels = make(map[string]*Tunnel)
+	s.Unlock()
+
+	to.Lock()
+	defer to.Unlock()
+	for url, t := range tunnels {
+		if atomic.LoadInt32(&t.closing) == 1 {
+			continue
+		}
+
+		t.moveTo(to)
+		to.tunnels[url] = t
+		to.resumed[url] = t
+	}
+	to.Info("Resuming %d tunnels", len(to.resumed))
+}
+
+// claimResumed returns the tunnel handed over from the previous session instance
+// bound at url if the client hasn't already claimed it
+func (s *Session) claimResumed(url, protocol string) (*Tunnel, bool) {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.resumed[url]
+	if !ok || t.req.Protocol != protocol {
+		return nil, false
+	}
+	delete(s.resumed, url)
+
+	// the client is ready for the connections queued while it was away
+	t.resume()
+	return t, true
+}
+
+// releaseResumed unbinds the tunnels handed over from the previous session instance
+// which the client did not bind again during the grace period
+func (s *Session) releaseResumed() {
+	s.Lock()
+	resumed := s.resumed
+	s.resumed = make(map[string]*Tunnel)
+	s.Unlock()
+
+	for url := range resumed {
+		s.Info("Client did not resume tunnel %s", url)
+		s.Unbind(url)
+	}
+}
+
+// drain stops the session from binding new tunnels and closes the public listeners
+// of the tunnels it has already bound. Connections which are already being proxied
+// are unaffected.
+func (s *Session) drain() {
+	atomic.StoreInt32(&s.draining, 1)
+
+	for _, t := range s.Tunnels() {
+		t.shutdown()
+	}
+}
+
 func (s *Session) Shutdown() {
-	s.recoverPanic("Session.Shutdown")
+	defer s.recoverPanic("Session.Shutdown")
+
+	// the session may be shut down by the client, the registry or an operator; only do it once
+	if !atomic.CompareAndSwapInt32(&s.closing, 0, 1) {
+		return
+	}
 
 	s.guard.BeginShutdown()
 	defer s.guard.CompleteShutdown()
@@ -258,7 +642,7 @@ func (s *Session) Shutdown() {
 	}
 
 	// shutdown all of the tunnels
-	for _, t := range s.tunnels {
+	for _, t := range s.Tunnels() {
 		t.shutdown()
 	}
 
@@ -287,7 +671,7 @@ func (s *Session) openProxy(clientAddr, tunnelUrl string) (pxy conn.Conn, err er
 		Url:        tunnelUrl,
 	}
 
-	if err = proto.WriteMsg(pxy, startProxy); err != nil {
+	if err = proto.WriteMsgCodec(pxy, s.codec, startProxy); err != nil {
 		return
 	}
 
@@ -307,6 +691,7 @@ func (s *Session) delTunnel(url string) (*Tunnel, bool) {
 	t, ok := s.tunnels[url]
 	if ok {
 		delete(s.tunnels, url)
+		delete(s.resumed, url)
 	}
 	return t, ok
 }
@@ -328,3 +713,53 @@ func (s *Session) Id() string {
 func (s *Session) Start() time.Time {
 	return s.start
 }
+
+// Identity returns who the session authenticated as, or nil if it is anonymous
+func (s *Session) Identity() *Identity {
+	s.Lock()
+	defer s.Unlock()
+	return s.identity
+}
+
+// SetIdentity records who the session authenticated as. It is meant to be
+// called from the OnAuth hook.
+func (s *Session) SetIdentity(identity *Identity) {
+	s.Lock()
+	defer s.Unlock()
+	s.identity = identity
+}
+
+// Capabilities returns the optional protocol features both the client and the
+// server support. They are negotiated before the OnAuth hook runs. The returned
+// map must not be modified.
+func (s *Session) Capabilities() proto.Capabilities {
+	return s.capabilities
+}
+
+// Latency returns the round trip time of the latest heartbeat the client answered,
+// or zero if heartbeats are disabled or the client hasn't answered one yet
+func (s *Session) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.latency))
+}
+
+// PeerCertificate returns the verified certificate the client presented when it
+// connected over TLS, or nil if it didn't present one
+func (s *Session) PeerCertificate() *PeerCertificate {
+	return s.peerCert
+}
+
+// RemoteAddr returns the network address of the client on the other end of the session
+func (s *Session) RemoteAddr() net.Addr {
+	return s.mux.RemoteAddr()
+}
+
+// Tunnels returns a snapshot of the tunnels currently bound by the session
+func (s *Session) Tunnels() []*Tunnel {
+	s.Lock()
+	defer s.Unlock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
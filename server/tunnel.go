@@ -1,12 +1,15 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	conn "github.com/inconshreveable/go-tunnel/conn"
 	log "github.com/inconshreveable/go-tunnel/log"
 	proto "github.com/inconshreveable/go-tunnel/proto"
+	binder "github.com/inconshreveable/go-tunnel/server/binder"
 	"net"
 	"runtime/debug"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -25,15 +28,36 @@ type Tunnel struct {
 	// tcp listener
 	listener net.Listener
 
-	// parent session
+	// parent session, changes when a disconnected session is resumed
 	sess *Session
 
+	// closed when a parked tunnel is resumed or shut down, nil unless the tunnel is parked
+	parked chan struct{}
+
+	// limits the number of public connections waiting for a parked tunnel to resume
+	queue chan struct{}
+
+	// synchronizes access to sess and parked
+	sync.Mutex
+
+	// server metrics
+	metrics *metrics
+
 	// logger
 	log.Logger
 
 	// closing
 	closing int32
 
+	// number of public connections currently being proxied
+	conns int64
+
+	// lifetime connection and byte counts, see metrics
+	connsOpened int64
+	connsClosed int64
+	bytesIn     int64
+	bytesOut    int64
+
 	// tunnel hooks
 	hooks TunnelHooks
 }
@@ -49,19 +73,30 @@ type TunnelHooks interface {
 // on a control channel
 func newTunnel(b *proto.Bind, sess *Session, binders Binders, hooks TunnelHooks) (t *Tunnel, err error) {
 	t = &Tunnel{
-		req:    b,
-		start:  time.Now(),
-		sess:   sess,
-		Logger: log.NewTaggedLogger(sess.id, "tunnel"),
-		hooks:  hooks,
+		req:     b,
+		start:   time.Now(),
+		sess:    sess,
+		Logger:  log.NewTaggedLogger(sess.id, "tunnel"),
+		hooks:   hooks,
+		metrics: sess.metrics,
 	}
 
-	binder, ok := binders[t.req.Protocol]
+	protoBinder, ok := binders[t.req.Protocol]
 	if !ok {
 		return nil, fmt.Errorf("Can't bind for %s connections", t.req.Protocol)
 	}
 
-	if t.listener, t.url, err = binder.Bind(b.Options); err != nil {
+	// let the session's identity bind the names and ports reserved for it
+	if ownerBinder, ok := protoBinder.(binder.OwnerBinder); ok {
+		var owner string
+		if identity := sess.Identity(); identity != nil {
+			owner = identity.Name
+		}
+		t.listener, t.url, err = ownerBinder.BindOwner(owner, b.Options)
+	} else {
+		t.listener, t.url, err = protoBinder.Bind(b.Options)
+	}
+	if err != nil {
 		return
 	}
 
@@ -79,17 +114,26 @@ func newTunnel(b *proto.Bind, sess *Session, binders Binders, hooks TunnelHooks)
 }
 
 func (t *Tunnel) shutdown() error {
-	t.Info("Shutting down")
-
 	// mark that we're shutting down
 	if !atomic.CompareAndSwapInt32(&t.closing, 0, 1) {
 		return fmt.Errorf("Already shutting down")
 	}
 
+	t.Info("Shutting down")
+
+	// wake up any connections waiting for the tunnel to resume
+	t.Lock()
+	if t.parked != nil {
+		close(t.parked)
+		t.parked = nil
+	}
+	t.Unlock()
+
 	// shut down the public listener
 	if err := t.listener.Close(); err != nil {
 		return err
 	}
+	t.metrics.unbound(t.req.Protocol)
 
 	// call close hook
 	if err := t.hooks.OnTunnelClose(t); err != nil {
@@ -105,6 +149,92 @@ func (t *Tunnel) id() string {
 	return t.url
 }
 
+// Url returns the public url of the tunnel
+func (t *Tunnel) Url() string {
+	return t.url
+}
+
+// Bind returns the bind request that opened the tunnel
+func (t *Tunnel) Bind() *proto.Bind {
+	return t.req
+}
+
+// Start returns the time the tunnel was opened
+func (t *Tunnel) Start() time.Time {
+	return t.start
+}
+
+// Session returns the session the tunnel is bound on
+func (t *Tunnel) Session() *Session {
+	t.Lock()
+	defer t.Unlock()
+	return t.sess
+}
+
+// park holds the tunnel's public connections while its session is disconnected,
+// queueing at most queueSize of them until the tunnel is resumed
+func (t *Tunnel) park(queueSize int) {
+	t.Lock()
+	defer t.Unlock()
+
+	// a tunnel which was never claimed after a reconnect is still parked,
+	// keep the connections queued for it
+	if t.parked != nil {
+		return
+	}
+	t.parked = make(chan struct{})
+	t.queue = make(chan struct{}, queueSize)
+}
+
+// moveTo moves the tunnel to the new instance of its session
+func (t *Tunnel) moveTo(sess *Session) {
+	t.Lock()
+	defer t.Unlock()
+	t.sess = sess
+}
+
+// resume releases any public connections queued while the tunnel was parked
+func (t *Tunnel) resume() {
+	t.Lock()
+	defer t.Unlock()
+	if t.parked != nil {
+		close(t.parked)
+		t.parked = nil
+	}
+}
+
+// activeSession returns the session to proxy a new public connection over,
+// waiting for a parked tunnel to be resumed if there is room in its queue
+func (t *Tunnel) activeSession() (*Session, error) {
+	t.Lock()
+	sess, parked, queue := t.sess, t.parked, t.queue
+	t.Unlock()
+
+	if parked == nil {
+		return sess, nil
+	}
+
+	select {
+	case queue <- struct{}{}:
+		defer func() { <-queue }()
+	default:
+		return nil, errors.New("Session is disconnected")
+	}
+
+	t.Debug("Queueing connection until the session reconnects")
+	<-parked
+
+	if atomic.LoadInt32(&t.closing) == 1 {
+		return nil, errors.New("Tunnel closed before the session reconnected")
+	}
+	return t.Session(), nil
+}
+
+// Connections returns the number of public connections the tunnel is currently proxying
+func (t *Tunnel) Connections() int64 {
+	return atomic.LoadInt64(&t.conns)
+}
+
 func (t *Tunnel) recoverPanic(name string) {
 	if r := recover(); r != nil {
 		t.Error("%s failed with error %v: %s", name, r, debug.Stack())
@@ -146,11 +276,25 @@ func (t *Tunnel) handlePublic(publicConn conn.Conn) {
 		return
 	}
 
+	atomic.AddInt64(&t.conns, 1)
+	defer atomic.AddInt64(&t.conns, -1)
+
 	startTime := time.Now()
+	t.metrics.connOpened(t)
+
+	// find the session to proxy over
+	sess, err := t.activeSession()
+	if err != nil {
+		t.metrics.connClosed(t, 0, 0)
+		t.Warn("Dropping connection from %v: %v", publicConn.RemoteAddr(), err)
+		return
+	}
 
 	// open a proxy stream
-	proxyConn, err := t.sess.openProxy(publicConn.RemoteAddr().String(), t.url)
+	proxyConn, err := sess.openProxy(publicConn.RemoteAddr().String(), t.url)
 	if err != nil {
+		t.metrics.proxyFailed(t)
+		t.metrics.connClosed(t, 0, 0)
 		t.Error("Failed to open proxy connection: %v", err)
 		return
 	}
@@ -158,6 +302,7 @@ func (t *Tunnel) handlePublic(publicConn conn.Conn) {
 
 	// join the public and proxy connections
 	bytesIn, bytesOut := conn.Join(publicConn, proxyConn)
+	t.metrics.connClosed(t, bytesIn, bytesOut)
 
 	if err = t.hooks.OnConnectionClose(t, publicConn, time.Now().Sub(startTime), bytesIn, bytesOut); err != nil {
 		t.Error("OnConnectionClose hook failed: %v", err)
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	muxado "github.com/inconshreveable/muxado"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler returns an http.Handler which upgrades requests to WebSocket connections
+// and runs a tunnel session over each of them, for clients behind firewalls which only let
+// HTTP(S) through. The sessions are served alongside the ones accepted by Run, so Run should
+// be running. Mount the handler on an HTTPS server to encrypt the sessions:
+//
+//	http.Handle("/tunnel", srv.WebSocketHandler())
+//	go http.ListenAndServeTLS(":443", "cert.pem", "key.pem", nil)
+//	srv.Run()
+//
+// Clients connect with client.WebSocketDialer. Client certificates verified by the HTTPS
+// server are available from Session.PeerCertificate.
+func (s *Server) WebSocketHandler() http.Handler {
+	// tunnel clients aren't browsers and send no Origin, so don't check it
+	return &websocket.Server{Handler: s.serveWebSocket}
+}
+
+func (s *Server) serveWebSocket(ws *websocket.Conn) {
+	if atomic.LoadInt32(&s.closing) == 1 {
+		ws.Close()
+		return
+	}
+
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &webSocketConn{Conn: ws, remote: webSocketAddr(ws.Request().RemoteAddr)}
+
+	// the connection is closed once the handler returns, so run the session right here
+	s.runSession(s.newSession(muxado.Server(conn), ws.Request().TLS))
+}
+
+// webSocketConn is a WebSocket connection which reports the address of the client
+// rather than the origin of the request as its remote address
+type webSocketConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// webSocketAddr is the address of the client of a WebSocket connection
+type webSocketAddr string
+
+func (a webSocketAddr) Network() string { return "websocket" }
+func (a webSocketAddr) String() string  { return string(a) }
@@ -8,7 +8,23 @@ import (
 	"io/ioutil"
 )
 
-func ClientConfig(servername string, rootPaths []string) (*tls.Config, error) {
+// A ClientOption customizes the config built by ClientConfig, ClientSnakeoil or ClientTrusted
+type ClientOption func(*tls.Config) error
+
+// ClientCert makes the client present the certificate at crtPath, with the private
+// key at keyPath, to servers which require client certificates
+func ClientCert(crtPath, keyPath string) ClientOption {
+	return func(tlsConfig *tls.Config) error {
+		cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+		return nil
+	}
+}
+
+func ClientConfig(servername string, rootPaths []string, opts ...ClientOption) (*tls.Config, error) {
 	roots := make([][]byte, 0)
 
 	for _, certPath := range rootPaths {
@@ -19,28 +35,28 @@ func ClientConfig(servername string, rootPaths []string) (*tls.Config, error) {
 		roots = append(roots, bytes)
 	}
 
-	return clientConfigFromBytes(servername, roots)
+	return clientConfigFromBytes(servername, roots, opts)
 }
 
-func ClientSnakeoil() (tlsConfig *tls.Config, err error) {
+func ClientSnakeoil(opts ...ClientOption) (tlsConfig *tls.Config, err error) {
 	root, err := Asset("assets/tls/snakeoil.root.crt")
 	if err != nil {
 		return
 	}
 
-	return clientConfigFromBytes("snakeoil.example.com", [][]byte{root})
+	return clientConfigFromBytes("snakeoil.example.com", [][]byte{root}, opts)
 }
 
-func ClientTrusted(servername string) (tlsConfig *tls.Config, err error) {
+func ClientTrusted(servername string, opts ...ClientOption) (tlsConfig *tls.Config, err error) {
 	root, err := Asset("assets/tls/trusted.root.crt")
 	if err != nil {
 		return
 	}
 
-	return clientConfigFromBytes(servername, [][]byte{root})
+	return clientConfigFromBytes(servername, [][]byte{root}, opts)
 }
 
-func clientConfigFromBytes(servername string, roots [][]byte) (*tls.Config, error) {
+func clientConfigFromBytes(servername string, roots [][]byte, opts []ClientOption) (*tls.Config, error) {
 	pool := x509.NewCertPool()
 
 	for _, rootCrt := range roots {
@@ -57,8 +73,16 @@ func clientConfigFromBytes(servername string, roots [][]byte) (*tls.Config, erro
 		pool.AddCert(certs[0])
 	}
 
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		RootCAs:    pool,
 		ServerName: servername,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		if err := opt(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
 }
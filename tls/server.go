@@ -2,10 +2,57 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 )
 
-func ServerConfig(crtPath string, keyPath string) (tlsConfig *tls.Config, err error) {
+// A ServerOption customizes the config built by ServerConfig or ServerSnakeoil
+type ServerOption func(*tls.Config) error
+
+// RequireClientCert makes the server require every client to present a certificate
+// signed by one of the CAs in the PEM bundles at caPaths
+func RequireClientCert(caPaths ...string) ServerOption {
+	return clientAuth(tls.RequireAndVerifyClientCert, caPaths)
+}
+
+// VerifyClientCertIfGiven makes the server verify the certificates clients present
+// against the CAs in the PEM bundles at caPaths, but still accept clients without one
+func VerifyClientCertIfGiven(caPaths ...string) ServerOption {
+	return clientAuth(tls.VerifyClientCertIfGiven, caPaths)
+}
+
+func clientAuth(authType tls.ClientAuthType, caPaths []string) ServerOption {
+	return func(tlsConfig *tls.Config) (err error) {
+		if tlsConfig.ClientCAs, err = certPool(caPaths); err != nil {
+			return
+		}
+		tlsConfig.ClientAuth = authType
+		return
+	}
+}
+
+// certPool reads every certificate in the PEM bundles at paths
+func certPool(paths []string) (*x509.CertPool, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("No CA bundles given")
+	}
+
+	pool := x509.NewCertPool()
+	for _, path := range paths {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !pool.AppendCertsFromPEM(bytes) {
+			return nil, fmt.Errorf("No certificates in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+func ServerConfig(crtPath string, keyPath string, opts ...ServerOption) (tlsConfig *tls.Config, err error) {
 	var crtBytes, keyBytes []byte
 	if crtBytes, err = ioutil.ReadFile(crtPath); err != nil {
 		return
@@ -14,10 +61,10 @@ func ServerConfig(crtPath string, keyPath string) (tlsConfig *tls.Config, err er
 		return
 	}
 
-	return serverConfigFromBytes(crtBytes, keyBytes)
+	return serverConfigFromBytes(crtBytes, keyBytes, opts)
 }
 
-func ServerSnakeoil() (tlsConfig *tls.Config, err error) {
+func ServerSnakeoil(opts ...ServerOption) (tlsConfig *tls.Config, err error) {
 	crt, err := Asset("assets/tls/snakeoil.crt")
 	if err != nil {
 		return
@@ -28,7 +75,7 @@ func ServerSnakeoil() (tlsConfig *tls.Config, err error) {
 		return
 	}
 
-	tlsConfig, err = serverConfigFromBytes(crt, key)
+	tlsConfig, err = serverConfigFromBytes(crt, key, opts)
 	if err != nil {
 		return
 	}
@@ -36,7 +83,7 @@ func ServerSnakeoil() (tlsConfig *tls.Config, err error) {
 	return
 }
 
-func serverConfigFromBytes(crt, key []byte) (tlsConfig *tls.Config, err error) {
+func serverConfigFromBytes(crt, key []byte, opts []ServerOption) (tlsConfig *tls.Config, err error) {
 	var cert tls.Certificate
 	if cert, err = tls.X509KeyPair(crt, key); err != nil {
 		return
@@ -46,5 +93,11 @@ func serverConfigFromBytes(crt, key []byte) (tlsConfig *tls.Config, err error) {
 		Certificates: []tls.Certificate{cert},
 	}
 
+	for _, opt := range opts {
+		if err = opt(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
 	return
 }